@@ -0,0 +1,371 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// bayesq inspects and repairs redisqueue queues.
+//
+// The redis address is read from REDIS_ADDR, REDIS_PASSWORD, REDIS_DB and REDIS_MASTER,
+// either environment variables or a .env file, see the environment package.
+// REDIS_ADDR takes comma separated addresses of a cluster or sentinels.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cast"
+	"github.com/sszqdz/bayes-toolkit/environment"
+	"github.com/sszqdz/bayes-toolkit/json"
+	redisqueue "github.com/sszqdz/bayes-toolkit/redis-queue"
+)
+
+const usage = `usage: bayesq <command> [flags] [args]
+
+commands:
+  send     [-key k] [-delay d] [-idempotency k [-window d]] <stream> <val>
+  tail     [-from id] [-count n] [-follow] <stream>
+  stats    <stream> <group>
+  pending  [-consumer c] [-idle d] [-count n] <stream> <group>
+  claim    [-idle d] <stream> <group> <consumer> <id>...
+  dead     list   [-start ms] [-end ms] [-key k] [-err s] [-cursor id] [-count n] <stream> <group>
+  dead     show   <stream> <group> <dead-id>
+  dead     replay <stream> <group> [dead-id]...
+  dead     purge  [-start ms] [-batch n] <stream> <group>
+  dead     migrate [-batch n] <stream> <group>
+  trim     [-maxlen n] [-minid id] <stream>
+  group    create [-start id] <stream> <group>
+  group    reset  <stream> <group> <id>
+
+environment:
+  REDIS_ADDR (default 127.0.0.1:6379, comma separated for cluster or sentinel),
+  REDIS_PASSWORD, REDIS_DB, REDIS_MASTER (sentinel master name)`
+
+type command func(ctx context.Context, qr *redisqueue.QueueRunner, args []string) error
+
+var commands = map[string]command{
+	"send":    send,
+	"tail":    tail,
+	"stats":   stats,
+	"pending": pending,
+	"claim":   claim,
+	"dead":    dead,
+	"trim":    trim,
+	"group":   group,
+}
+
+var errUsage = errors.New(usage)
+
+func main() {
+	if len(os.Args) < 2 {
+		exit(errUsage)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		exit(errUsage)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	qr := redisqueue.NewQueueRunner(newClient())
+	err := cmd(ctx, qr, os.Args[2:])
+	_ = qr.Close()
+	exit(err)
+}
+
+func newClient() redis.UniversalClient {
+	addr := environment.Load("REDIS_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:6379"
+	}
+	return redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      strings.Split(addr, ","),
+		Password:   environment.Load("REDIS_PASSWORD"),
+		DB:         cast.ToInt(environment.Load("REDIS_DB")),
+		MasterName: environment.Load("REDIS_MASTER"),
+	})
+}
+
+func exit(err error) {
+	if err == nil {
+		os.Exit(0)
+	}
+	fmt.Fprintln(os.Stderr, err)
+	if errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	os.Exit(1)
+}
+
+// parse parses the flags and checks the number of positional args
+func parse(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {}
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		return nil, errUsage
+	}
+	return fs.Args(), nil
+}
+
+func printJSON(v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func send(ctx context.Context, qr *redisqueue.QueueRunner, args []string) error {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	key := fs.String("key", "", "message key")
+	delay := fs.Duration("delay", 0, "deliver after the delay, needs a RunDelay loop")
+	idempotencyKey := fs.String("idempotency", "", "send once per idempotency key within the window")
+	window := fs.Duration("window", 24*time.Hour, "idempotency window")
+	args, err := parse(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	var id string
+	switch {
+	case *idempotencyKey != "":
+		id, err = qr.SendIdempotent(ctx, args[0], *idempotencyKey, *key, args[1], *window)
+		if errors.Is(err, redisqueue.ErrDuplicate) {
+			fmt.Println(id, "(duplicate)")
+			return nil
+		}
+	case *delay > 0:
+		id, err = qr.SendAfter(ctx, args[0], *delay, *key, args[1])
+	case *key != "":
+		id, err = qr.SendWithKey(ctx, args[0], *key, args[1])
+	default:
+		id, err = qr.Send(ctx, args[0], args[1])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	return nil
+}
+
+func tail(ctx context.Context, qr *redisqueue.QueueRunner, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	from := fs.String("from", "", "read after this id, defaults to $ (new messages only) with -follow and 0 without")
+	count := fs.Int64("count", 10, "messages per read")
+	follow := fs.Bool("follow", false, "keep waiting for new messages")
+	args, err := parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	id := *from
+	if id == "" {
+		id = "0"
+		if *follow {
+			id = "$"
+		}
+	}
+	block := time.Duration(-1)
+	if *follow {
+		// finite, blocking reads are not interrupted by ctx
+		block = 2 * time.Second
+	}
+	for ctx.Err() == nil {
+		xMessages, err := qr.Tail(ctx, args[0], id, *count, block)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for _, xMessage := range xMessages {
+			if err := printJSON(xMessage); err != nil {
+				return err
+			}
+			id = xMessage.ID
+		}
+		if !*follow && len(xMessages) == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+func stats(ctx context.Context, qr *redisqueue.QueueRunner, args []string) error {
+	args, err := parse(flag.NewFlagSet("stats", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	queueStats, err := qr.Stats(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return printJSON(queueStats)
+}
+
+func pending(ctx context.Context, qr *redisqueue.QueueRunner, args []string) error {
+	fs := flag.NewFlagSet("pending", flag.ContinueOnError)
+	consumer := fs.String("consumer", "", "only the messages of this consumer")
+	idle := fs.Duration("idle", 0, "min idle time")
+	count := fs.Int64("count", 100, "max messages")
+	args, err := parse(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	xPendingExts, err := qr.Pending(ctx, args[0], args[1], *consumer, *idle, *count)
+	if err != nil {
+		return err
+	}
+	return printJSON(xPendingExts)
+}
+
+func claim(ctx context.Context, qr *redisqueue.QueueRunner, args []string) error {
+	fs := flag.NewFlagSet("claim", flag.ContinueOnError)
+	idle := fs.Duration("idle", 0, "min idle time")
+	args, err := parse(fs, args, 4, -1)
+	if err != nil {
+		return err
+	}
+	xMessages, err := qr.Claim(ctx, args[0], args[1], args[2], *idle, args[3:]...)
+	if err != nil {
+		return err
+	}
+	return printJSON(xMessages)
+}
+
+func dead(ctx context.Context, qr *redisqueue.QueueRunner, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	sub, args := args[0], args[1:]
+	switch sub {
+	case "list":
+		fs := flag.NewFlagSet("dead list", flag.ContinueOnError)
+		start := fs.Int64("start", 0, "only the messages dead at or after this unix ms")
+		end := fs.Int64("end", 0, "only the messages dead at or before this unix ms")
+		key := fs.String("key", "", "message key")
+		errContains := fs.String("err", "", "substring of the last error")
+		cursor := fs.String("cursor", "", "continue after this dead id")
+		count := fs.Int64("count", 20, "max messages")
+		args, err := parse(fs, args, 2, 2)
+		if err != nil {
+			return err
+		}
+		filter := &redisqueue.DeadFilter{
+			Key:         *key,
+			ErrContains: *errContains,
+			Cursor:      *cursor,
+			Count:       *count,
+		}
+		if *start > 0 {
+			filter.Start = time.UnixMilli(*start)
+		}
+		if *end > 0 {
+			filter.End = time.UnixMilli(*end)
+		}
+		deadMessages, next, err := qr.ListDead(ctx, args[0], args[1], filter)
+		if err != nil {
+			return err
+		}
+		return printJSON(map[string]any{"messages": deadMessages, "cursor": next})
+	case "show":
+		args, err := parse(flag.NewFlagSet("dead show", flag.ContinueOnError), args, 3, 3)
+		if err != nil {
+			return err
+		}
+		deadMessage, err := qr.GetDead(ctx, args[0], args[1], args[2])
+		if err != nil {
+			return err
+		}
+		return printJSON(deadMessage)
+	case "replay":
+		args, err := parse(flag.NewFlagSet("dead replay", flag.ContinueOnError), args, 2, -1)
+		if err != nil {
+			return err
+		}
+		n, err := qr.ReplayDead(ctx, args[0], args[1], args[2:]...)
+		fmt.Println("replayed", n)
+		return err
+	case "purge":
+		fs := flag.NewFlagSet("dead purge", flag.ContinueOnError)
+		start := fs.Int64("start", 0, "only the messages dead at or after this unix ms")
+		batch := fs.Int64("batch", 100, "messages per round trip")
+		args, err := parse(fs, args, 2, 2)
+		if err != nil {
+			return err
+		}
+		n, err := qr.PurgeDead(ctx, args[0], args[1], *start, *batch)
+		fmt.Println("purged", n)
+		return err
+	case "migrate":
+		fs := flag.NewFlagSet("dead migrate", flag.ContinueOnError)
+		batch := fs.Int64("batch", 100, "messages per round trip")
+		args, err := parse(fs, args, 2, 2)
+		if err != nil {
+			return err
+		}
+		n, err := qr.MigrateLegacyDead(ctx, args[0], args[1], *batch)
+		fmt.Println("migrated", n)
+		return err
+	}
+	return errUsage
+}
+
+func trim(ctx context.Context, qr *redisqueue.QueueRunner, args []string) error {
+	fs := flag.NewFlagSet("trim", flag.ContinueOnError)
+	maxLen := fs.Int64("maxlen", 0, "keep about this many messages")
+	minId := fs.String("minid", "", "drop the messages before this id")
+	args, err := parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *maxLen <= 0 && *minId == "" {
+		return errUsage
+	}
+	n, err := qr.Trim(ctx, args[0], *maxLen, *minId)
+	fmt.Println("trimmed", n)
+	return err
+}
+
+func group(ctx context.Context, qr *redisqueue.QueueRunner, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	sub, args := args[0], args[1:]
+	switch sub {
+	case "create":
+		fs := flag.NewFlagSet("group create", flag.ContinueOnError)
+		start := fs.String("start", "$", "first id delivered to the group is the one after this, 0 for all")
+		args, err := parse(fs, args, 2, 2)
+		if err != nil {
+			return err
+		}
+		if err := qr.CreateGroup(ctx, args[0], args[1], *start); err != nil {
+			if strings.HasPrefix(err.Error(), "BUSYGROUP") {
+				return errors.New("group already exists")
+			}
+			return err
+		}
+		fmt.Println("OK")
+		return nil
+	case "reset":
+		args, err := parse(flag.NewFlagSet("group reset", flag.ContinueOnError), args, 3, 3)
+		if err != nil {
+			return err
+		}
+		if err := qr.ResetGroup(ctx, args[0], args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+		return nil
+	}
+	return errUsage
+}
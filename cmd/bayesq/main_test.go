@@ -0,0 +1,168 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	redisqueue "github.com/sszqdz/bayes-toolkit/redis-queue"
+)
+
+// runCommand runs the command line as main does and returns what it prints
+func runCommand(t *testing.T, qr *redisqueue.QueueRunner, line string) (string, error) {
+	t.Helper()
+	args := strings.Fields(line)
+	cmd, ok := commands[args[0]]
+	if !ok {
+		t.Fatalf("unknown command %q", args[0])
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	err = cmd(context.Background(), qr, args[1:])
+	_ = w.Close()
+	return <-out, err
+}
+
+func mustRun(t *testing.T, qr *redisqueue.QueueRunner, line string, want ...string) string {
+	t.Helper()
+	out, err := runCommand(t, qr, line)
+	if err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+	for _, s := range want {
+		if !strings.Contains(out, s) {
+			t.Errorf("%s printed %q, want %q", line, out, s)
+		}
+	}
+	return out
+}
+
+type deadConsumer struct {
+	info *redisqueue.QueueInfo
+	dead chan string
+}
+
+func (c *deadConsumer) Info() *redisqueue.QueueInfo {
+	return c.info
+}
+
+func (c *deadConsumer) Consume(ctx context.Context, delivery *redisqueue.Delivery) error {
+	c.dead <- delivery.ID
+	return fmt.Errorf("bad message %s: %w", delivery.Val(), redisqueue.ErrDead)
+}
+
+func TestCommands(t *testing.T) {
+	mr := miniredis.RunT(t)
+	qr := redisqueue.NewQueueRunner(redis.NewClient(&redis.Options{Addr: mr.Addr()}), redisqueue.WithAutoCreateStream())
+	defer qr.Close()
+
+	mustRun(t, qr, "group create -start 0 s g", "OK")
+	if _, err := runCommand(t, qr, "group create s g"); err == nil || err.Error() != "group already exists" {
+		t.Errorf("group create twice = %v", err)
+	}
+	id := strings.TrimSpace(mustRun(t, qr, "send s v1"))
+	mustRun(t, qr, "send -key k s v2")
+	mustRun(t, qr, "send -idempotency i s v3")
+	mustRun(t, qr, "send -idempotency i s v3", "(duplicate)")
+	mustRun(t, qr, "send -delay 1h s later")
+	mustRun(t, qr, "tail s", id, `"v1"`, `"v2"`, `"v3"`)
+	mustRun(t, qr, "stats s g", `"length": 3`, `"lag": 3`, `"delayed_length": 1`)
+
+	// a message read by c of g2 but not acked is pending
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	mustRun(t, qr, "group create -start 0 s g2", "OK")
+	if err := client.XReadGroup(context.Background(), &redis.XReadGroupArgs{
+		Group:    "g2",
+		Consumer: "c",
+		Streams:  []string{"s", ">"},
+		Count:    1,
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, qr, "pending s g2", id, `"c"`)
+	mustRun(t, qr, "claim s g2 c2 "+id, id, `"v1"`)
+	mustRun(t, qr, "pending -consumer c2 s g2", id)
+
+	// deliver the messages to a consumer that sends them to the dead stream
+	consumer := &deadConsumer{
+		info: &redisqueue.QueueInfo{UserQueueInfo: &redisqueue.UserQueueInfo{
+			Streams: []string{"s", ">"},
+			Group:   "g",
+			Block:   50 * time.Millisecond,
+		}},
+		dead: make(chan string, 3),
+	}
+	if err := qr.RunConsumer(consumer); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-consumer.dead:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d messages dead", i)
+		}
+	}
+	waitDead := func() string {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			out := mustRun(t, qr, "dead list s g")
+			if strings.Count(out, `"DeadID"`) == 3 || time.Now().After(deadline) {
+				return out
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	out := waitDead()
+	if n := strings.Count(out, `"DeadID"`); n != 3 {
+		t.Fatalf("dead list printed %d messages: %s", n, out)
+	}
+	mustRun(t, qr, "dead list -key k s g", `"v2"`)
+	mustRun(t, qr, "dead list -err v3 s g", "bad message v3")
+	deadId := out[strings.Index(out, `"DeadID": "`)+len(`"DeadID": "`):]
+	deadId = deadId[:strings.IndexByte(deadId, '"')]
+	mustRun(t, qr, "dead show s g "+deadId, deadId, `"v1"`)
+	if _, err := runCommand(t, qr, "dead show s g 1-0"); !errors.Is(err, redisqueue.ErrDeadNotFound) {
+		t.Errorf("dead show of a missing message = %v", err)
+	}
+	// the replayed message stays in the stream once the consumer is gone
+	if err := qr.Remove(context.Background(), "g:s"); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, qr, "pending s g", "[]")
+	mustRun(t, qr, "dead replay s g "+deadId, "replayed 1")
+	mustRun(t, qr, "tail -from "+id+" s", `"v1"`)
+	mustRun(t, qr, "dead list s g", `"v2"`, `"v3"`)
+	mustRun(t, qr, "trim -maxlen 1 s", "trimmed")
+	mustRun(t, qr, "dead purge s g", "purged 2")
+	mustRun(t, qr, "dead migrate s g", "migrated 0")
+	// group reset runs XGROUP SETID, which miniredis does not support
+
+	if _, err := runCommand(t, qr, "dead"); !errors.Is(err, errUsage) {
+		t.Errorf("dead without subcommand = %v", err)
+	}
+	if _, err := runCommand(t, qr, "trim s"); !errors.Is(err, errUsage) {
+		t.Errorf("trim without bound = %v", err)
+	}
+}
@@ -4,14 +4,19 @@
 
 package redislock
 
-import "github.com/redis/go-redis/v9"
+import (
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
 
 var (
-	client        *redis.Client
+	client        redis.UniversalClient
 	listKeySuffix = "-locklist"
 )
 
-func RegisterClient(redisClient *redis.Client, suffix ...string) {
+// RegisterClient accepts a single node, sentinel or cluster client
+func RegisterClient(redisClient redis.UniversalClient, suffix ...string) {
 	if redisClient == nil {
 		panic("nil client")
 	}
@@ -21,9 +26,27 @@ func RegisterClient(redisClient *redis.Client, suffix ...string) {
 	}
 }
 
-func getClient() *redis.Client {
+func getClient() redis.UniversalClient {
 	if client == nil {
 		panic("nil client")
 	}
 	return client
 }
+
+// listKeyName returns the wait list of the lock "key<suffix>". On a cluster an untagged key
+// gets the list "{key}<suffix>" to share its slot, the other clients keep the former name.
+func listKeyName(key string) string {
+	if _, ok := getClient().(*redis.ClusterClient); !ok || hasHashTag(key) {
+		return key + listKeySuffix
+	}
+	return "{" + key + "}" + listKeySuffix
+}
+
+func hasHashTag(key string) bool {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return false
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	return end > 0
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redislock
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cast"
+)
+
+// Lease is a lock owned by a token, e.g. one per process, that expires unless renewed.
+// TryLease takes it when it is free and renews it when the token already holds it.
+func TryLease(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	return TryLeaseWith(ctx, getClient(), key, token, ttl)
+}
+
+// TryLeaseWith is TryLease on the given client instead of the registered one
+func TryLeaseWith(ctx context.Context, redisClient redis.UniversalClient, key, token string, ttl time.Duration) (bool, error) {
+	result, err := evalScript(ctx, redisClient, ScriptLease, []string{key}, token, ttl.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+
+	return cast.ToInt(result) == 1, nil
+}
+
+// ReleaseLease frees the lease if the token holds it
+func ReleaseLease(ctx context.Context, key, token string) (bool, error) {
+	return ReleaseLeaseWith(ctx, getClient(), key, token)
+}
+
+// ReleaseLeaseWith is ReleaseLease on the given client instead of the registered one
+func ReleaseLeaseWith(ctx context.Context, redisClient redis.UniversalClient, key, token string) (bool, error) {
+	result, err := evalScript(ctx, redisClient, ScriptReleaseLease, []string{key}, token)
+	if err != nil {
+		return false, err
+	}
+
+	return cast.ToInt(result) == 1, nil
+}
+
+func evalScript(ctx context.Context, redisClient redis.UniversalClient, script RedisScripEnum, keys []string, args ...any) (any, error) {
+	result, err := redisClient.EvalSha(ctx, script.GetHash(), keys, args...).Result()
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		result, err = redisClient.Eval(ctx, script.GetScript(), keys, args...).Result()
+	}
+	return result, err
+}
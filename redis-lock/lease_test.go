@@ -0,0 +1,52 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redislock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLease(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	ctx := context.Background()
+
+	try := func(token string, want bool) {
+		t.Helper()
+		ok, err := TryLeaseWith(ctx, client, "lease", token, time.Second)
+		if err != nil || ok != want {
+			t.Errorf("TryLeaseWith(%s) = %v, %v, want %v", token, ok, err, want)
+		}
+	}
+	try("a", true)
+	try("b", false)
+
+	// renewing keeps it past the first ttl
+	mr.FastForward(700 * time.Millisecond)
+	try("a", true)
+	mr.FastForward(700 * time.Millisecond)
+	try("b", false)
+	if holder, _ := mr.Get("lease"); holder != "a" {
+		t.Errorf("lease held by %q, want a", holder)
+	}
+
+	if ok, err := ReleaseLeaseWith(ctx, client, "lease", "b"); err != nil || ok {
+		t.Errorf("ReleaseLeaseWith(b) = %v, %v, want false", ok, err)
+	}
+	if ok, err := ReleaseLeaseWith(ctx, client, "lease", "a"); err != nil || !ok {
+		t.Errorf("ReleaseLeaseWith(a) = %v, %v, want true", ok, err)
+	}
+	try("b", true)
+
+	// an expired lease is free
+	mr.FastForward(time.Second)
+	try("a", true)
+}
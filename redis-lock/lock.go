@@ -35,7 +35,7 @@ func ReleaseHardLock(ctx context.Context, key string) error {
 }
 
 func Lock(ctx context.Context, timeout time.Duration, key string, ex uint) error {
-	listKey := key + listKeySuffix
+	listKey := listKeyName(key)
 	script := ScriptTryLock.GetScript()
 	sha1 := ScriptTryLock.GetHash()
 	result, err := getClient().EvalSha(ctx, sha1, []string{key, listKey}, ex).Result()
@@ -68,7 +68,7 @@ func Lock(ctx context.Context, timeout time.Duration, key string, ex uint) error
 }
 
 func ReleaseLock(ctx context.Context, key string, ex uint) error {
-	listKey := key + listKeySuffix
+	listKey := listKeyName(key)
 	script := ScriptUnlock.GetScript()
 	sha1 := ScriptUnlock.GetHash()
 
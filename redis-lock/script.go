@@ -14,6 +14,8 @@ type RedisScripEnum int32
 const (
 	ScriptTryLock RedisScripEnum = iota
 	ScriptUnlock
+	ScriptLease
+	ScriptReleaseLease
 )
 
 const (
@@ -36,14 +38,35 @@ then
     redis.call('LPUSH', KEYS[2], '1')
     redis.call('EXPIRE', KEYS[2], ARGV[1] + 10)
 end`
+
+	scriptLease string = `local holder = redis.call('GET', KEYS[1])
+if holder == ARGV[1]
+then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+if (holder)
+then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1`
+
+	scriptReleaseLease string = `if redis.call('GET', KEYS[1]) == ARGV[1]
+then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
 )
 
-var scriptDic = make(map[RedisScripEnum]string, 2)
-var hashDic = make(map[RedisScripEnum]string, 2)
+var scriptDic = make(map[RedisScripEnum]string, 4)
+var hashDic = make(map[RedisScripEnum]string, 4)
 
 func init() {
 	scriptDic[ScriptTryLock] = scriptTryLock
 	scriptDic[ScriptUnlock] = scriptUnlock
+	scriptDic[ScriptLease] = scriptLease
+	scriptDic[ScriptReleaseLease] = scriptReleaseLease
 
 	initHash()
 }
@@ -0,0 +1,103 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrDeadNotFound = errors.New("dead message not found")
+
+func (qr *QueueRunner) CreateGroup(ctx context.Context, stream, group, start string) error {
+	if start == "" {
+		start = "$"
+	}
+	_, err := qr.client.XGroupCreateMkStream(ctx, stream, group, start).Result()
+	return err
+}
+
+// ResetGroup moves the last delivered ID of the group, pending messages are kept
+func (qr *QueueRunner) ResetGroup(ctx context.Context, stream, group, id string) error {
+	_, err := qr.client.XGroupSetID(ctx, stream, group, id).Result()
+	return err
+}
+
+// Pending lists pending messages idle for at least idle, of one consumer or of all when consumer is empty
+func (qr *QueueRunner) Pending(ctx context.Context, stream, group, consumer string, idle time.Duration, count int64) ([]redis.XPendingExt, error) {
+	return qr.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   stream,
+		Group:    group,
+		Idle:     idle,
+		Start:    "-",
+		End:      "+",
+		Count:    count,
+		Consumer: consumer,
+	}).Result()
+}
+
+// Claim transfers pending messages idle for at least minIdle to consumer
+func (qr *QueueRunner) Claim(ctx context.Context, stream, group, consumer string, minIdle time.Duration, ids ...string) ([]redis.XMessage, error) {
+	return qr.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		Consumer: consumer,
+		MinIdle:  minIdle,
+		Messages: ids,
+	}).Result()
+}
+
+// Tail reads the messages after id without a group, block < 0 returns at once
+func (qr *QueueRunner) Tail(ctx context.Context, stream, id string, count int64, block time.Duration) ([]redis.XMessage, error) {
+	xStreams, err := qr.client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{stream, id},
+		Count:   count,
+		Block:   block,
+	}).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(xStreams) == 0 {
+		return nil, nil
+	}
+	return xStreams[0].Messages, nil
+}
+
+// Trim keeps about maxLen messages when maxLen > 0, and drops the messages before minId when it is not empty
+func (qr *QueueRunner) Trim(ctx context.Context, stream string, maxLen int64, minId string) (int64, error) {
+	var trimmed int64
+	if maxLen > 0 {
+		n, err := qr.client.XTrimMaxLenApprox(ctx, stream, maxLen, 0).Result()
+		if err != nil {
+			return trimmed, err
+		}
+		trimmed += n
+	}
+	if minId != "" {
+		n, err := qr.client.XTrimMinID(ctx, stream, minId).Result()
+		if err != nil {
+			return trimmed, err
+		}
+		trimmed += n
+	}
+	return trimmed, nil
+}
+
+func (qr *QueueRunner) GetDead(ctx context.Context, stream, group, deadId string) (*DeadMessage, error) {
+	xMessages, err := qr.getDead(ctx, deadStreamName(stream, group), []string{deadId})
+	if err != nil {
+		return nil, err
+	}
+	if len(xMessages) == 0 {
+		return nil, ErrDeadNotFound
+	}
+	return parseDeadMessage(stream, group, xMessages[0]), nil
+}
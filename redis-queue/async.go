@@ -0,0 +1,146 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/conc"
+)
+
+type AsyncProducerInfo struct {
+	Stream string
+	// MaxLen keeps the stream at about MaxLen entries, zero means no trimming
+	MaxLen int64
+	// FlushSize is the max number of entries sent in one round trip
+	FlushSize int
+	// FlushInterval is how long an entry may wait for a full batch
+	FlushInterval time.Duration
+	// Buffer is the number of entries waiting to be flushed before Send blocks
+	Buffer    int
+	NotifyErr func(entry Entry, err error)
+}
+
+// AsyncProducer buffers entries and sends them with SendBatchTrim,
+// failures are reported to NotifyErr. Buffered entries are flushed
+// when the runner is closed, Shutdown waits for them.
+type AsyncProducer struct {
+	qr      *QueueRunner
+	info    *AsyncProducerInfo
+	entries chan Entry
+	mu      sync.RWMutex
+	closed  bool
+}
+
+func (qr *QueueRunner) NewAsyncProducer(info *AsyncProducerInfo) (*AsyncProducer, error) {
+	checkAsyncProducerInfo(info)
+	p := &AsyncProducer{
+		qr:      qr,
+		info:    info,
+		entries: make(chan Entry, info.Buffer),
+	}
+	if err := qr.spawn(func(wg *conc.WaitGroup) { wg.Go(p.run) }); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func checkAsyncProducerInfo(info *AsyncProducerInfo) {
+	if info == nil {
+		panic("nil async producer info")
+	}
+	if info.Stream == "" {
+		panic("empty stream")
+	}
+	if info.MaxLen < 0 {
+		panic("invalid max len")
+	}
+	if info.FlushSize < 0 {
+		panic("invalid flush size")
+	}
+	if info.FlushSize == 0 {
+		info.FlushSize = 100
+	}
+	if info.FlushInterval < 0 {
+		panic("invalid flush interval")
+	}
+	if info.FlushInterval == 0 {
+		info.FlushInterval = 100 * time.Millisecond
+	}
+	if info.Buffer < 0 {
+		panic("invalid buffer")
+	}
+	if info.Buffer == 0 {
+		info.Buffer = 10 * info.FlushSize
+	}
+	if info.NotifyErr == nil {
+		info.NotifyErr = func(entry Entry, err error) {}
+	}
+}
+
+// Send queues the entry, it blocks while the buffer is full
+// and fails with ErrRunnerClosed once the runner is closing.
+func (p *AsyncProducer) Send(ctx context.Context, key, val string) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrRunnerClosed
+	}
+	select {
+	case p.entries <- Entry{Key: key, Val: val}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *AsyncProducer) run() {
+	buf := make([]Entry, 0, p.info.FlushSize)
+	tick := time.NewTicker(p.info.FlushInterval)
+	defer tick.Stop()
+	closeChan := p.qr.closeChan
+	for {
+		select {
+		case <-closeChan:
+			closeChan = nil
+			// keep receiving so blocked senders return before the channel is closed
+			go func() {
+				p.mu.Lock()
+				p.closed = true
+				close(p.entries)
+				p.mu.Unlock()
+			}()
+		case entry, ok := <-p.entries:
+			if !ok {
+				p.flush(buf)
+				return
+			}
+			buf = append(buf, entry)
+			if len(buf) >= p.info.FlushSize {
+				p.flush(buf)
+				buf = buf[:0]
+			}
+		case <-tick.C:
+			if len(buf) > 0 {
+				p.flush(buf)
+				buf = buf[:0]
+			}
+		}
+	}
+}
+
+func (p *AsyncProducer) flush(entries []Entry) {
+	if len(entries) == 0 {
+		return
+	}
+	_, errs := p.qr.SendBatchTrim(p.qr.ctx, p.info.Stream, entries, p.info.MaxLen)
+	for i, err := range errs {
+		if err != nil {
+			p.info.NotifyErr(entries[i], err)
+		}
+	}
+}
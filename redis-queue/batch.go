@@ -0,0 +1,114 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrBatchResults = errors.New("batch results do not match deliveries")
+
+// BatchHandler returns one error per delivery, a nil slice means all succeeded.
+type BatchHandler func(ctx context.Context, deliveries []*Delivery) []error
+
+// IBatchConsumer receives all messages of one read at once,
+// successes are acked with a single pipelined XACK.
+type IBatchConsumer interface {
+	Info() *QueueInfo
+	ConsumeBatch(ctx context.Context, deliveries []*Delivery) []error
+}
+
+func (qr *QueueRunner) processBatch(info *QueueInfo, deliveries []*Delivery) {
+	for i, delivery := range deliveries {
+		if !qr.limit(info, delivery) {
+			for _, rest := range deliveries[i+1:] {
+				qr.releaseDedupe(info, rest)
+			}
+			deliveries = deliveries[:i]
+			break
+		}
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	errs := qr.handleBatch(info, deliveries)
+	succeeded := make([]*Delivery, 0, len(deliveries))
+	for i, delivery := range deliveries {
+		if errs != nil && errs[i] != nil {
+			qr.fail(info, delivery, errs[i])
+			continue
+		}
+		succeeded = append(succeeded, delivery)
+	}
+	qr.ackBatch(info, succeeded, true)
+}
+
+func (qr *QueueRunner) handleBatch(info *QueueInfo, deliveries []*Delivery) []error {
+	ctx, cancel := qr.handleContext(info)
+	defer cancel()
+
+	start := time.Now()
+	errs := info.batchHandler(ctx, deliveries)
+	duration := time.Since(start)
+	if errs != nil && len(errs) != len(deliveries) {
+		errs = make([]error, len(deliveries))
+		for i := range errs {
+			errs[i] = ErrBatchResults
+		}
+	}
+	// one latency sample per stream of the batch
+	for stream := range countByStream(deliveries) {
+		qr.metrics.Handled(stream, info.UserQueueInfo.Group, duration, errors.Join(errs...))
+	}
+	return errs
+}
+
+// ackBatch acks the deliveries in one round trip,
+// handled marks them done for dedupe, it is false for dead and duplicate messages.
+func (qr *QueueRunner) ackBatch(info *QueueInfo, deliveries []*Delivery, handled bool) bool {
+	if len(deliveries) == 0 {
+		return true
+	}
+	idsMap := make(map[string][]string, 1)
+	retriedIdsMap := make(map[string][]string, 0)
+	for _, delivery := range deliveries {
+		idsMap[delivery.Stream] = append(idsMap[delivery.Stream], delivery.ID)
+		if delivery.RetryCount > 0 {
+			retriedIdsMap[delivery.Stream] = append(retriedIdsMap[delivery.Stream], delivery.ID)
+		}
+	}
+
+	if handled {
+		qr.markDedupeDone(info, deliveries)
+	}
+	pipe := qr.client.Pipeline()
+	for stream, ids := range idsMap {
+		pipe.XAck(qr.ctx, stream, info.UserQueueInfo.Group, ids...)
+	}
+	for stream, ids := range retriedIdsMap {
+		qr.pipeClearMeta(pipe, info, stream, ids...)
+	}
+	cmds, err := pipe.Exec(qr.ctx)
+	if err == nil {
+		for stream, ids := range idsMap {
+			qr.metrics.Acked(stream, info.UserQueueInfo.Group, len(ids))
+		}
+		qr.leaveOrder(info, deliveries)
+		return true
+	}
+	if err == redis.ErrClosed {
+		return false
+	}
+	for _, cmd := range cmds {
+		if cmd.Err() != nil {
+			info.NotifyErr(cmd.Args()[1].(string), "", cmd.Err())
+		}
+	}
+	return false
+}
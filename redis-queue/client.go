@@ -7,21 +7,41 @@ package redisqueue
 import (
 	"context"
 	"errors"
+	"io"
+	"net"
+	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cast"
 )
 
+var (
+	ErrStreamNotFound = errors.New("stream not found")
+	// ErrDuplicate is returned along with the ID of the entry sent before with the same idempotency key
+	ErrDuplicate = errors.New("duplicate message")
+)
+
+// ConnError wraps the errors of talking to redis, the send may or may not have happened
+type ConnError struct {
+	Err error
+}
+
+func (e *ConnError) Error() string {
+	return "redis connection: " + e.Err.Error()
+}
+
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+// Send, SendWithKey and the other sends accept a partitioned topic registered with WithPartitionedTopic
+// in place of a stream, the message goes to the partition of its key.
 func (qr *QueueRunner) Send(ctx context.Context, stream, val string) (string, error) {
 	if stream == "" || val == "" {
 		return "", errors.New("invalid params")
 	}
 
-	return qr.client.XAdd(ctx, &redis.XAddArgs{
-		Stream:     stream,
-		NoMkStream: true,
-		ID:         "*",
-		Values:     map[string]interface{}{valStr: val},
-	}).Result()
+	return qr.xAdd(ctx, stream, map[string]any{valStr: val})
 }
 
 func (qr *QueueRunner) SendWithKey(ctx context.Context, stream, key, val string) (string, error) {
@@ -29,13 +49,150 @@ func (qr *QueueRunner) SendWithKey(ctx context.Context, stream, key, val string)
 		return "", errors.New("invalid params")
 	}
 
-	return qr.client.XAdd(ctx, &redis.XAddArgs{
-		Stream:     stream,
-		NoMkStream: true,
+	return qr.xAdd(ctx, stream, map[string]any{
+		keyStr: key,
+		valStr: val,
+	})
+}
+
+// SendIdempotent sends the message once per idempotencyKey within window,
+// retries of the same send return ErrDuplicate and the ID of the first entry.
+// The entry carries idempotencyKey, consumers dedupe on it with DedupeQueueInfo.UseIdempotencyKey.
+// key is optional, as in SendWithKey.
+func (qr *QueueRunner) SendIdempotent(ctx context.Context, stream, idempotencyKey, key, val string, window time.Duration) (string, error) {
+	if stream == "" || idempotencyKey == "" || val == "" || window <= 0 {
+		return "", errors.New("invalid params")
+	}
+
+	// a keyless retry has to reach the partition of the first send to be detected
+	routeKey := key
+	if routeKey == "" {
+		routeKey = idempotencyKey
+	}
+	stream = qr.route(stream, routeKey)
+	mkStream := "0"
+	if qr.mkStream {
+		mkStream = "1"
+	}
+	args := []any{window.Milliseconds(), mkStream, valStr, val, idemStr, idempotencyKey}
+	if key != "" {
+		args = append(args, keyStr, key)
+	}
+	result, err := qr.evalScript(ctx, scriptSendIdempotent, []string{idempotencyKeyName(stream, idempotencyKey), stream}, args...)
+	if err != nil {
+		return "", sendErr(err)
+	}
+	results, _ := result.([]any)
+	if len(results) == 0 {
+		return "", errors.New("unexpected script result")
+	}
+	switch cast.ToInt64(results[0]) {
+	case 1:
+		return cast.ToString(results[1]), nil
+	case 0:
+		return cast.ToString(results[1]), ErrDuplicate
+	}
+	return "", ErrStreamNotFound
+}
+
+// Entry is one message of SendBatch, Key may be empty
+type Entry struct {
+	Key string
+	Val string
+	// IdempotencyKey is optional, consumers dedupe on it with DedupeQueueInfo.UseIdempotencyKey
+	IdempotencyKey string
+}
+
+func (e Entry) values() map[string]any {
+	values := map[string]any{valStr: e.Val}
+	if e.Key != "" {
+		values[keyStr] = e.Key
+	}
+	if e.IdempotencyKey != "" {
+		values[idemStr] = e.IdempotencyKey
+	}
+	return values
+}
+
+// SendBatch sends the entries in one round trip and returns their IDs in order,
+// errs is nil when all succeeded, otherwise it holds one error per entry.
+func (qr *QueueRunner) SendBatch(ctx context.Context, stream string, entries []Entry) (ids []string, errs []error) {
+	return qr.SendBatchTrim(ctx, stream, entries, 0)
+}
+
+// SendBatchTrim is SendBatch keeping the stream at about maxLen entries, zero means no trimming
+func (qr *QueueRunner) SendBatchTrim(ctx context.Context, stream string, entries []Entry, maxLen int64) (ids []string, errs []error) {
+	ids = make([]string, len(entries))
+	if len(entries) == 0 {
+		return ids, nil
+	}
+	if stream == "" || maxLen < 0 {
+		return ids, fillErrs(len(entries), errors.New("invalid params"))
+	}
+	for _, entry := range entries {
+		if entry.Val == "" {
+			return ids, fillErrs(len(entries), errors.New("invalid params"))
+		}
+	}
+
+	pipe := qr.client.Pipeline()
+	cmds := make([]*redis.StringCmd, 0, len(entries))
+	for _, entry := range entries {
+		cmds = append(cmds, pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream:     qr.route(stream, entry.Key),
+			NoMkStream: !qr.mkStream,
+			MaxLen:     maxLen,
+			Approx:     maxLen > 0,
+			ID:         "*",
+			Values:     entry.values(),
+		}))
+	}
+	if _, err := pipe.Exec(ctx); err == nil {
+		for i, cmd := range cmds {
+			ids[i] = cmd.Val()
+		}
+		return ids, nil
+	}
+	errs = make([]error, len(entries))
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			errs[i] = sendErr(err)
+			continue
+		}
+		ids[i] = cmd.Val()
+	}
+	return ids, errs
+}
+
+func fillErrs(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+func (qr *QueueRunner) xAdd(ctx context.Context, stream string, values map[string]any) (string, error) {
+	id, err := qr.client.XAdd(ctx, &redis.XAddArgs{
+		Stream:     qr.route(stream, cast.ToString(values[keyStr])),
+		NoMkStream: !qr.mkStream,
 		ID:         "*",
-		Values: map[string]interface{}{
-			keyStr: key,
-			valStr: val,
-		},
+		Values:     values,
 	}).Result()
+	if err != nil {
+		return "", sendErr(err)
+	}
+	return id, nil
+}
+
+// sendErr tells a missing stream, XADD NOMKSTREAM replies nil, from connection failures
+func sendErr(err error) error {
+	if err == redis.Nil {
+		return ErrStreamNotFound
+	}
+	var netErr net.Error
+	if err == redis.ErrClosed || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return &ConnError{Err: err}
+	}
+	return err
 }
@@ -0,0 +1,93 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSendIdempotent(t *testing.T) {
+	qr, mr := newRedisRunner(t)
+	ctx := context.Background()
+	if _, err := qr.SendIdempotent(ctx, "s", "i", "", "v", time.Minute); !errors.Is(err, ErrStreamNotFound) {
+		t.Fatalf("SendIdempotent to a missing stream = %v, want ErrStreamNotFound", err)
+	}
+	// the failed send does not hold the idempotency key
+	if mr.Exists(idempotencyKeyName("s", "i")) {
+		t.Error("idempotency key set by a failed send")
+	}
+
+	qr.mkStream = true
+	id, err := qr.SendIdempotent(ctx, "s", "i", "k", "v", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup, err := qr.SendIdempotent(ctx, "s", "i", "k", "v2", time.Minute)
+	if !errors.Is(err, ErrDuplicate) || dup != id {
+		t.Errorf("second SendIdempotent = %q, %v, want %q, ErrDuplicate", dup, err, id)
+	}
+	if other, err := qr.SendIdempotent(ctx, "s", "j", "k", "v", time.Minute); err != nil || other == id {
+		t.Errorf("SendIdempotent with another key = %q, %v", other, err)
+	}
+	xMessages, err := qr.client.XRange(ctx, "s", "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xMessages) != 2 {
+		t.Fatalf("stream holds %d entries, want 2", len(xMessages))
+	}
+	if values := xMessages[0].Values; values[idemStr] != "i" || values[keyStr] != "k" || values[valStr] != "v" {
+		t.Errorf("entry values %v", values)
+	}
+
+	// the key expires with the window
+	mr.FastForward(time.Minute)
+	if again, err := qr.SendIdempotent(ctx, "s", "i", "k", "v", time.Minute); err != nil || again == id {
+		t.Errorf("SendIdempotent after the window = %q, %v", again, err)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	qr, _ := newRedisRunner(t, WithPartitionedTopic("t", 2))
+	ctx := context.Background()
+	if _, errs := qr.SendBatch(ctx, "t", []Entry{{Val: "v"}, {Val: ""}}); len(errs) != 2 || errs[0] == nil || errs[1] == nil {
+		t.Errorf("SendBatch with an empty val = %v, want an error per entry", errs)
+	}
+
+	// only the first partition exists, entries routed to the other one fail alone
+	if err := qr.client.XGroupCreateMkStream(ctx, PartitionName("t", 0), "g", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	var key0, key1 string
+	for i := 0; key0 == "" || key1 == ""; i++ {
+		key := "k" + string(rune('a'+i))
+		if PartitionOf(key, 2) == 0 {
+			key0 = key
+		} else {
+			key1 = key
+		}
+	}
+	ids, errs := qr.SendBatch(ctx, "t", []Entry{{Key: key0, Val: "a"}, {Key: key1, Val: "b"}, {Key: key0, Val: "c"}})
+	if len(ids) != 3 || len(errs) != 3 {
+		t.Fatalf("SendBatch = %v, %v", ids, errs)
+	}
+	if ids[0] == "" || errs[0] != nil || ids[2] == "" || errs[2] != nil {
+		t.Errorf("entries of the existing partition = %v, %v", ids, errs)
+	}
+	if ids[1] != "" || !errors.Is(errs[1], ErrStreamNotFound) {
+		t.Errorf("entry of the missing partition = %q, %v, want ErrStreamNotFound", ids[1], errs[1])
+	}
+
+	ids, errs = qr.SendBatch(ctx, "t", []Entry{{Key: key0, Val: "d"}, {Key: key0, Val: "e"}})
+	if errs != nil || len(ids) != 2 || ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("SendBatch = %v, %v, want two ids and nil errs", ids, errs)
+	}
+	if n := qr.client.XLen(ctx, PartitionName("t", 0)).Val(); n != 4 {
+		t.Errorf("partition holds %d entries, want 4", n)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/sszqdz/bayes-toolkit/json"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported type")
+	ErrUnknownCodec    = errors.New("unknown codec")
+)
+
+type Codec interface {
+	// ContentType is stored in the stream entry so consumers know how to decode it
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSONCodec    Codec = jsonCodec{}
+	ProtoCodec   Codec = protoCodec{}
+	MsgpackCodec Codec = msgpackCodec{}
+	// RawCodec passes []byte and string through unchanged
+	RawCodec Codec = rawCodec{}
+)
+
+var codecs sync.Map
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(ProtoCodec)
+	RegisterCodec(MsgpackCodec)
+	RegisterCodec(RawCodec)
+}
+
+// RegisterCodec makes the codec available to consumers decoding entries with its content type
+func RegisterCodec(codec Codec) {
+	if codec == nil {
+		panic("nil codec")
+	}
+	codecs.Store(codec.ContentType(), codec)
+}
+
+func lookupCodec(contentType string) (Codec, bool) {
+	codec, ok := codecs.Load(contentType)
+	if !ok {
+		return nil, false
+	}
+	return codec.(Codec), true
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protoCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	// v is usually a pointer to a nil message pointer, e.g. **pb.Msg
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Pointer {
+		return ErrUnsupportedType
+	}
+	if rv.Elem().IsNil() {
+		rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+	}
+	m, ok := rv.Elem().Interface().(proto.Message)
+	if !ok {
+		return ErrUnsupportedType
+	}
+	return proto.Unmarshal(data, m)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) ContentType() string {
+	return "application/octet-stream"
+}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	switch t := v.(type) {
+	case []byte:
+		return t, nil
+	case string:
+		return []byte(t), nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	switch t := v.(type) {
+	case *[]byte:
+		*t = append((*t)[:0], data...)
+		return nil
+	case *string:
+		*t = string(data)
+		return nil
+	}
+	return ErrUnsupportedType
+}
@@ -0,0 +1,323 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/sourcegraph/conc"
+)
+
+var (
+	ErrQueueExists   = errors.New("queue already exists")
+	ErrQueueNotFound = errors.New("queue not found")
+	ErrQueueStopped  = errors.New("queue stopped")
+)
+
+// queueControl holds the goroutines of a running queue
+type queueControl struct {
+	mu        sync.Mutex
+	paused    bool
+	resumed   chan struct{} // closed by Resume
+	stopped   bool
+	stops     map[string]chan struct{} // closed to stop the consumer
+	retryStop chan struct{}
+	// reportStop is nil without metrics
+	reportStop chan struct{}
+	wgs        []*conc.WaitGroup
+	promoted   []*Delivery // next messages of ordered keys, claimed on ack
+}
+
+func newQueueControl() *queueControl {
+	return &queueControl{
+		stops: make(map[string]chan struct{}),
+	}
+}
+
+// resumedChan returns nil when the queue is not paused
+func (control *queueControl) resumedChan() chan struct{} {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if !control.paused {
+		return nil
+	}
+	return control.resumed
+}
+
+func (control *queueControl) isPaused() bool {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	return control.paused
+}
+
+func (control *queueControl) addPromoted(delivery *Delivery) {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	control.promoted = append(control.promoted, delivery)
+}
+
+func (control *queueControl) takePromoted() []*Delivery {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	promoted := control.promoted
+	control.promoted = nil
+	return promoted
+}
+
+// owns tells whether the consumer is one of the running consumers of the queue
+func (control *queueControl) owns(consumer string) bool {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	_, ok := control.stops[consumer]
+	return ok
+}
+
+func (qr *QueueRunner) register(info *QueueInfo) error {
+	qr.queuesMu.Lock()
+	defer qr.queuesMu.Unlock()
+	if _, ok := qr.queues[info.Name]; ok {
+		return ErrQueueExists
+	}
+	qr.queues[info.Name] = info
+	return nil
+}
+
+func (qr *QueueRunner) unregister(info *QueueInfo) {
+	qr.queuesMu.Lock()
+	defer qr.queuesMu.Unlock()
+	if qr.queues[info.Name] == info {
+		delete(qr.queues, info.Name)
+	}
+}
+
+func (qr *QueueRunner) queue(name string) (*QueueInfo, error) {
+	qr.queuesMu.Lock()
+	defer qr.queuesMu.Unlock()
+	info, ok := qr.queues[name]
+	if !ok {
+		return nil, ErrQueueNotFound
+	}
+	return info, nil
+}
+
+// Queues returns the names of the queues run by the runner
+func (qr *QueueRunner) Queues() []string {
+	qr.queuesMu.Lock()
+	defer qr.queuesMu.Unlock()
+	names := make([]string, 0, len(qr.queues))
+	for name := range qr.queues {
+		names = append(names, name)
+	}
+	return names
+}
+
+// start runs the consumers, the retry loop and the report loop of the queue, control.mu is held
+func (qr *QueueRunner) start(info *QueueInfo, consumers []string) error {
+	control := info.control
+	return qr.spawn(func(wg *conc.WaitGroup) {
+		for _, consumer := range consumers {
+			stop := make(chan struct{})
+			control.stops[consumer] = stop
+			wg.Go(func() { qr.normalRun(info, consumer, stop) })
+		}
+		if control.stopped || len(control.wgs) == 0 {
+			control.stopped = false
+			if !info.RetryQueueInfo.Stop {
+				retryStop := make(chan struct{})
+				control.retryStop = retryStop
+				wg.Go(func() { qr.retryRun(info, retryStop) })
+			}
+			if _, ok := qr.metrics.(NopMetrics); !ok {
+				reportStop := make(chan struct{})
+				control.reportStop = reportStop
+				wg.Go(func() { qr.reportRun(info, reportStop) })
+			}
+		}
+		control.wgs = append(control.wgs, wg)
+	})
+}
+
+// stop closes the consumers and the retry loop of the queue, control.mu is held
+func (qr *QueueRunner) stop(info *QueueInfo) {
+	control := info.control
+	if control.stopped {
+		return
+	}
+	control.stopped = true
+	for consumer, stop := range control.stops {
+		close(stop)
+		delete(control.stops, consumer)
+	}
+	if control.retryStop != nil {
+		close(control.retryStop)
+		control.retryStop = nil
+	}
+	if control.reportStop != nil {
+		close(control.reportStop)
+		control.reportStop = nil
+	}
+	if control.paused {
+		control.paused = false
+		close(control.resumed)
+	}
+}
+
+// waitQueue waits for the goroutines of the queue to exit
+func (qr *QueueRunner) waitQueue(ctx context.Context, info *QueueInfo) error {
+	info.control.mu.Lock()
+	wgs := info.control.wgs
+	info.control.mu.Unlock()
+
+	waitChan := make(chan error, 1)
+	go func() {
+		var firstErr error
+		for _, wg := range wgs {
+			if err := wg.WaitAndRecover().AsError(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		waitChan <- firstErr
+	}()
+	select {
+	case err := <-waitChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitActive blocks while the queue is paused, false means the goroutine has to exit
+func (qr *QueueRunner) waitActive(info *QueueInfo, stop chan struct{}) bool {
+	for {
+		if qr.closing.Load() {
+			return false
+		}
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+		resumed := info.control.resumedChan()
+		if resumed == nil {
+			return true
+		}
+		select {
+		case <-resumed:
+		case <-stop:
+			return false
+		case <-qr.closeChan:
+			return false
+		}
+	}
+}
+
+// Pause stops reading and retrying messages of the queue, messages being handled are finished
+func (qr *QueueRunner) Pause(name string) error {
+	info, err := qr.queue(name)
+	if err != nil {
+		return err
+	}
+	control := info.control
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if control.stopped {
+		return ErrQueueStopped
+	}
+	if !control.paused {
+		control.paused = true
+		control.resumed = make(chan struct{})
+	}
+	return nil
+}
+
+// Resume restarts a paused or drained queue
+func (qr *QueueRunner) Resume(name string) error {
+	info, err := qr.queue(name)
+	if err != nil {
+		return err
+	}
+	control := info.control
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if control.stopped {
+		return qr.start(info, info.UserQueueInfo.consumers)
+	}
+	if control.paused {
+		control.paused = false
+		close(control.resumed)
+	}
+	return nil
+}
+
+// Drain stops reading and retrying messages of the queue and waits for the messages
+// being handled, the queue can be resumed later. If ctx is done first, ctx.Err() is returned
+// and the messages are still finished in the background.
+func (qr *QueueRunner) Drain(ctx context.Context, name string) error {
+	info, err := qr.queue(name)
+	if err != nil {
+		return err
+	}
+	info.control.mu.Lock()
+	qr.stop(info)
+	info.control.mu.Unlock()
+	return qr.waitQueue(ctx, info)
+}
+
+// Remove drains the queue and forgets it, so it can be run again
+func (qr *QueueRunner) Remove(ctx context.Context, name string) error {
+	info, err := qr.queue(name)
+	if err != nil {
+		return err
+	}
+	info.control.mu.Lock()
+	qr.stop(info)
+	info.control.mu.Unlock()
+	qr.unregister(info)
+	return qr.waitQueue(ctx, info)
+}
+
+// SetConsumerSize starts or stops consumers of the queue, a stopped consumer finishes its messages first.
+// A drained queue resumes with the new size.
+func (qr *QueueRunner) SetConsumerSize(ctx context.Context, name string, size int) error {
+	if size < 1 {
+		return errors.New("invalid consumer size")
+	}
+	info, err := qr.queue(name)
+	if err != nil {
+		return err
+	}
+	control := info.control
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	userQueueInfo := info.UserQueueInfo
+	current := userQueueInfo.ConsumerSize
+	consumers := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		consumers = append(consumers, userQueueInfo.consumer+"-"+strconv.Itoa(i))
+	}
+	if size > current && !control.stopped {
+		added := consumers[current:]
+		if err := qr.createConsumers(ctx, info, added); err != nil {
+			return err
+		}
+		if err := qr.start(info, added); err != nil {
+			return err
+		}
+	}
+	if size < current && !control.stopped {
+		for _, consumer := range userQueueInfo.consumers[size:] {
+			if stop, ok := control.stops[consumer]; ok {
+				close(stop)
+				delete(control.stops, consumer)
+			}
+		}
+	}
+	userQueueInfo.ConsumerSize = size
+	userQueueInfo.consumers = consumers
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRunQueuesSharingGroup(t *testing.T) {
+	qr, _ := newRedisRunner(t, WithAutoCreateStream())
+	handled := make(chan string, 2)
+	newConsumer := func(stream string) *testConsumer {
+		return &testConsumer{
+			info: &QueueInfo{UserQueueInfo: &UserQueueInfo{
+				Streams: []string{stream, ">"},
+				Group:   "g",
+				Block:   50 * time.Millisecond,
+			}},
+			consume: func(ctx context.Context, delivery *Delivery) error {
+				handled <- delivery.Stream + ":" + delivery.Val()
+				return nil
+			},
+		}
+	}
+	if err := qr.RunConsumer(newConsumer("a"), newConsumer("b")); err != nil {
+		t.Fatal(err)
+	}
+	names := qr.Queues()
+	slices.Sort(names)
+	if want := []string{"g:a", "g:b"}; !slices.Equal(names, want) {
+		t.Errorf("queues %v, want %v", names, want)
+	}
+
+	ctx := context.Background()
+	for _, stream := range []string{"a", "b"} {
+		if _, err := qr.Send(ctx, stream, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make([]string, 0, 2)
+	for len(got) < 2 {
+		select {
+		case val := <-handled:
+			got = append(got, val)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handled %v", got)
+		}
+	}
+	slices.Sort(got)
+	if want := []string{"a:v", "b:v"}; !slices.Equal(got, want) {
+		t.Errorf("handled %v, want %v", got, want)
+	}
+
+	if err := qr.Pause("g:a"); err != nil {
+		t.Errorf("Pause = %v", err)
+	}
+}
+
+func TestRunQueueNameTaken(t *testing.T) {
+	qr, _ := newRedisRunner(t)
+	newConsumer := func(stream string) *testConsumer {
+		return &testConsumer{
+			info: &QueueInfo{Name: "q", UserQueueInfo: &UserQueueInfo{
+				Streams: []string{stream, ">"},
+				Group:   "g",
+				Block:   50 * time.Millisecond,
+			}},
+			consume: func(ctx context.Context, delivery *Delivery) error { return nil },
+		}
+	}
+	if err := qr.RunConsumer(newConsumer("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := qr.RunConsumer(newConsumer("b")); !errors.Is(err, ErrQueueExists) {
+		t.Errorf("RunConsumer = %v, want %v", err, ErrQueueExists)
+	}
+}
@@ -6,57 +6,528 @@ package redisqueue
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cast"
+	"github.com/sszqdz/bayes-toolkit/json"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
+var ErrDead = errors.New("send to dead")
+
+// Dead wraps err so that the message is sent to the dead store at once instead of being retried
+func Dead(err error) error {
+	return fmt.Errorf("%w: %w", ErrDead, err)
+}
+
+const (
+	DeadReasonMaxRetry = "max_retry"
+	DeadReasonRejected = "rejected"
+)
+
+// fields of a dead stream entry
+const (
+	deadIdStr            = "id"
+	deadKeyStr           = "key"
+	deadValuesStr        = "values"
+	deadReasonStr        = "reason"
+	deadErrorStr         = "error"
+	deadRetryStr         = "retry"
+	deadFirstDeliveryStr = "first_delivery"
+	deadConsumerStr      = "consumer"
+	deadErrorsStr        = "errors"
+)
+
+// DeadMessage is an entry of the dead stream of a stream and group
+type DeadMessage struct {
+	DeadID        string // ID in the dead stream
+	Stream        string
+	Group         string
+	ID            string // ID in the original stream
+	Values        map[string]string
+	Reason        string
+	LastError     string
+	Errors        []*HandleError // newest first
+	RetryCount    int64
+	Consumer      string
+	FirstDelivery time.Time
+	DeadAt        time.Time
+}
+
+func (m *DeadMessage) Key() string {
+	return m.Values[keyStr]
+}
+
+func (m *DeadMessage) Val() string {
+	return m.Values[valStr]
+}
+
+// DeadFilter selects dead messages, zero fields match everything.
+// Cursor is the DeadID after which the listing continues.
+type DeadFilter struct {
+	Start       time.Time
+	End         time.Time
+	Key         string
+	ErrContains string
+	Cursor      string
+	Count       int64
+}
+
+func (f *DeadFilter) match(m *DeadMessage) bool {
+	if f.Key != "" && m.Key() != f.Key {
+		return false
+	}
+	if f.ErrContains != "" && !strings.Contains(m.LastError, f.ErrContains) {
+		return false
+	}
+	return true
+}
+
+// ListDead returns up to filter.Count matching dead messages and the cursor of the next page,
+// the cursor is empty when there are no more dead messages.
+func (qr *QueueRunner) ListDead(ctx context.Context, stream, group string, filter *DeadFilter) ([]*DeadMessage, string, error) {
+	if filter == nil {
+		filter = &DeadFilter{}
+	}
+	count := filter.Count
+	if count <= 0 {
+		count = 100
+	}
+	start := "-"
+	if !filter.Start.IsZero() {
+		start = cast.ToString(filter.Start.UnixMilli())
+	}
+	if filter.Cursor != "" {
+		start = "(" + filter.Cursor
+	}
+	end := "+"
+	if !filter.End.IsZero() {
+		end = cast.ToString(filter.End.UnixMilli())
+	}
+
+	deadName := deadStreamName(stream, group)
+	deadMessages := make([]*DeadMessage, 0, count)
+	for {
+		xMessages, err := qr.client.XRangeN(ctx, deadName, start, end, count).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, xMessage := range xMessages {
+			deadMessage := parseDeadMessage(stream, group, xMessage)
+			if !filter.match(deadMessage) {
+				continue
+			}
+			deadMessages = append(deadMessages, deadMessage)
+			if int64(len(deadMessages)) == count {
+				return deadMessages, xMessage.ID, nil
+			}
+		}
+		if int64(len(xMessages)) < count {
+			return deadMessages, "", nil
+		}
+		start = "(" + xMessages[len(xMessages)-1].ID
+	}
+}
+
+// ReplayDead adds the dead messages back to their original stream and removes them from the dead stream,
+// all dead messages are replayed when no ids are given.
+func (qr *QueueRunner) ReplayDead(ctx context.Context, stream, group string, deadIds ...string) (int64, error) {
+	deadName := deadStreamName(stream, group)
+	if len(deadIds) > 0 {
+		xMessages, err := qr.getDead(ctx, deadName, deadIds)
+		if err != nil {
+			return 0, err
+		}
+		return qr.replayDead(ctx, stream, group, xMessages)
+	}
+
+	// messages dying again while being replayed get newer ids and are left for the next replay
+	last, err := qr.client.XRevRangeN(ctx, deadName, "+", "-", 1).Result()
+	if err != nil || len(last) == 0 {
+		return 0, err
+	}
+	end := last[0].ID
+	var replayed int64
+	for {
+		xMessages, err := qr.client.XRangeN(ctx, deadName, "-", end, 100).Result()
+		if err != nil {
+			return replayed, err
+		}
+		if len(xMessages) == 0 {
+			return replayed, nil
+		}
+		n, err := qr.replayDead(ctx, stream, group, xMessages)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+}
+
+func (qr *QueueRunner) replayDead(ctx context.Context, stream, group string, xMessages []redis.XMessage) (int64, error) {
+	deadName := deadStreamName(stream, group)
+	var replayed int64
+	for _, xMessage := range xMessages {
+		deadMessage := parseDeadMessage(stream, group, xMessage)
+		values := make(map[string]any, len(deadMessage.Values))
+		for k, v := range deadMessage.Values {
+			values[k] = v
+		}
+		if _, err := qr.xAdd(ctx, stream, values); err != nil {
+			return replayed, err
+		}
+		if _, err := qr.client.XDel(ctx, deadName, xMessage.ID).Result(); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+func (qr *QueueRunner) getDead(ctx context.Context, deadName string, deadIds []string) ([]redis.XMessage, error) {
+	pipe := qr.client.Pipeline()
+	cmds := make([]*redis.XMessageSliceCmd, 0, len(deadIds))
+	for _, id := range deadIds {
+		cmds = append(cmds, pipe.XRangeN(ctx, deadName, id, id, 1))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	xMessages := make([]redis.XMessage, 0, len(deadIds))
+	for _, cmd := range cmds {
+		xMessages = append(xMessages, cmd.Val()...)
+	}
+	return xMessages, nil
+}
+
+// PageDead returns dead messages as field value pairs, like HSCAN on the dead hash of the former releases:
+// the field is the original message ID and the value the JSON of its redis.XMessage.
+// The cursor encodes the dead ID to go on from, 0 starts and ends the iteration,
+// and like with HSCAN a message may be returned twice.
+//
+// Deprecated: use ListDead.
 func (qr *QueueRunner) PageDead(ctx context.Context, stream, group string, cursor uint64, count int64) ([]string, uint64, error) {
-	return qr.client.HScan(ctx, deadHashMapName(stream, group), cursor, "", count).Result()
+	if count <= 0 {
+		count = 10
+	}
+	start := "-"
+	if cursor > 0 {
+		start = unpackDeadCursor(cursor)
+	}
+	// one more to know where the next page starts
+	xMessages, err := qr.client.XRangeN(ctx, deadStreamName(stream, group), start, "+", count+1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	var next uint64
+	if int64(len(xMessages)) > count {
+		next = packDeadCursor(xMessages[count].ID)
+		xMessages = xMessages[:count]
+	}
+	pairs := make([]string, 0, 2*len(xMessages))
+	for _, xMessage := range xMessages {
+		deadMessage := parseDeadMessage(stream, group, xMessage)
+		values := make(map[string]any, len(deadMessage.Values))
+		for k, v := range deadMessage.Values {
+			values[k] = v
+		}
+		data, err := json.MarshalToString(redis.XMessage{ID: deadMessage.ID, Values: values})
+		if err != nil {
+			return nil, 0, err
+		}
+		pairs = append(pairs, deadMessage.ID, data)
+	}
+	return pairs, next, nil
+}
+
+// packDeadCursor packs a dead ID in 44 bits of ms and 20 of seq,
+// a larger seq starts the next page at the first ID of its ms.
+func packDeadCursor(id string) uint64 {
+	ms, seq := parseStreamID(id)
+	if seq >= 1<<20 {
+		seq = 0
+	}
+	return ms<<20 | seq
+}
+
+func unpackDeadCursor(cursor uint64) string {
+	return strconv.FormatUint(cursor>>20, 10) + "-" + strconv.FormatUint(cursor&(1<<20-1), 10)
 }
 
+// HandleDead passes the dead messages of the original message IDs, those given to NotifyDead,
+// to handler and removes the handled ones from the dead stream. IDs without dead message are ignored.
 func (qr *QueueRunner) HandleDead(ctx context.Context, handler HandleFunc, stream, group string, ids ...string) []error {
 	if len(ids) == 0 {
 		return nil
 	}
-	errs := make([]error, 0)
-	deadName := deadHashMapName(stream, group)
-	msgIfcs, err := qr.client.HMGet(ctx, deadName, ids...).Result()
+	deadIds, err := qr.deadIdsOf(ctx, stream, group, ids)
 	if err != nil {
-		errs = append(errs, err)
-		return errs
+		return []error{err}
 	}
-	succedlIds := make([]string, 0, len(ids))
-	for i, msgIfc := range msgIfcs {
-		if msgIfc == nil {
-			succedlIds = append(succedlIds, ids[i])
-			continue
+	return qr.HandleDeadByDeadID(ctx, handler, stream, group, deadIds...)
+}
+
+// deadIdsOf finds the dead IDs of the original message IDs, a message dies after it is added
+// so the dead stream is scanned from the oldest of them.
+func (qr *QueueRunner) deadIdsOf(ctx context.Context, stream, group string, ids []string) ([]string, error) {
+	wanted := make(map[string]struct{}, len(ids))
+	oldest := "+"
+	for _, id := range ids {
+		wanted[id] = struct{}{}
+		oldest = minStreamID(oldest, id)
+	}
+	ms, _ := parseStreamID(oldest)
+	start := strconv.FormatUint(ms, 10)
+	deadName := deadStreamName(stream, group)
+	deadIds := make([]string, 0, len(ids))
+	for {
+		xMessages, err := qr.client.XRangeN(ctx, deadName, start, "+", 100).Result()
+		if err != nil {
+			return nil, err
 		}
-		var xMessage *redis.XMessage
-		if err = json.UnmarshalFromString(msgIfc.(string), &xMessage); err != nil {
-			errs = append(errs, err)
-			continue
+		for _, xMessage := range xMessages {
+			if _, ok := wanted[cast.ToString(xMessage.Values[deadIdStr])]; ok {
+				deadIds = append(deadIds, xMessage.ID)
+			}
 		}
-		if xMessage == nil {
-			errs = append(errs, err)
-			continue
+		if len(xMessages) < 100 || len(deadIds) == len(wanted) {
+			return deadIds, nil
 		}
-		key, val := extractValues(xMessage.Values)
-		if err := handler(stream, key, val, xMessage.ID); err != nil {
+		start = "(" + xMessages[len(xMessages)-1].ID
+	}
+}
+
+// HandleDeadByDeadID passes the dead messages to handler and removes the handled ones from the dead stream
+func (qr *QueueRunner) HandleDeadByDeadID(ctx context.Context, handler HandleFunc, stream, group string, deadIds ...string) []error {
+	if len(deadIds) == 0 {
+		return nil
+	}
+	errs := make([]error, 0)
+	deadName := deadStreamName(stream, group)
+	xMessages, err := qr.getDead(ctx, deadName, deadIds)
+	if err != nil {
+		errs = append(errs, err)
+		return errs
+	}
+	succeedIds := make([]string, 0, len(xMessages))
+	for _, xMessage := range xMessages {
+		deadMessage := parseDeadMessage(stream, group, xMessage)
+		if err := handler(stream, deadMessage.Key(), deadMessage.Val(), deadMessage.ID); err != nil {
 			errs = append(errs, err)
 			continue
 		}
-		succedlIds = append(succedlIds, xMessage.ID)
+		succeedIds = append(succeedIds, xMessage.ID)
 	}
-	if len(succedlIds) == 0 {
+	if len(succeedIds) == 0 {
 		return errs
 	}
 
-	_, err = qr.client.HDel(ctx, deadName, succedlIds...).Result()
-	errs = append(errs, err)
+	if _, err = qr.client.XDel(ctx, deadName, succeedIds...).Result(); err != nil {
+		errs = append(errs, err)
+	}
 	return errs
 }
 
+// CleanDead deletes the dead messages that died at or after start, see PurgeDead
 func (qr *QueueRunner) CleanDead(ctx context.Context, stream, group string, start, batchSize int64) error {
-	_, err := qr.client.Del(ctx, deadHashMapName(stream, group)).Result()
+	_, err := qr.PurgeDead(ctx, stream, group, start, batchSize)
 	return err
 }
+
+// PurgeDead deletes the dead messages that died at or after start (unix milliseconds, 0 for all),
+// batchSize of them per round trip, and returns the number of deleted messages.
+func (qr *QueueRunner) PurgeDead(ctx context.Context, stream, group string, start, batchSize int64) (int64, error) {
+	if start < 0 {
+		return 0, errors.New("invalid params")
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	deadName := deadStreamName(stream, group)
+	from := "-"
+	if start > 0 {
+		from = cast.ToString(start)
+	}
+	var deleted int64
+	for {
+		ids := make([]string, 0, batchSize)
+		xMessages, err := qr.client.XRangeN(ctx, deadName, from, "+", batchSize).Result()
+		if err != nil {
+			return deleted, err
+		}
+		if len(xMessages) == 0 {
+			return deleted, nil
+		}
+		for _, xMessage := range xMessages {
+			ids = append(ids, xMessage.ID)
+		}
+		n, err := qr.client.XDel(ctx, deadName, ids...).Result()
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+		from = "(" + ids[len(ids)-1]
+	}
+}
+
+// MigrateLegacyDead moves the dead messages of the hash used by the former releases into the dead stream,
+// batchSize of them per round trip, and returns the number of moved messages.
+// The moved messages keep their original ID, their reason is DeadReasonMaxRetry and their DeadAt is the time of the move.
+func (qr *QueueRunner) MigrateLegacyDead(ctx context.Context, stream, group string, batchSize int64) (int64, error) {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	legacyName := legacyDeadHashName(stream, group)
+	deadName := deadStreamName(stream, group)
+	var moved int64
+	var cursor uint64
+	for {
+		fields, next, err := qr.client.HScan(ctx, legacyName, cursor, "", batchSize).Result()
+		if err != nil {
+			return moved, err
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			var xMessage redis.XMessage
+			if err := json.UnmarshalFromString(fields[i+1], &xMessage); err != nil {
+				return moved, fmt.Errorf("legacy dead message %s: %w", fields[i], err)
+			}
+			deadMessage := &DeadMessage{
+				Stream: stream,
+				Group:  group,
+				ID:     fields[i],
+				Values: make(map[string]string, len(xMessage.Values)),
+				Reason: DeadReasonMaxRetry,
+			}
+			for k, v := range xMessage.Values {
+				deadMessage.Values[k] = cast.ToString(v)
+			}
+			// added before deleted, an interrupted migration leaves duplicates rather than losing messages
+			if err := qr.client.XAdd(ctx, &redis.XAddArgs{
+				Stream: deadName,
+				ID:     "*",
+				Values: deadValues(deadMessage),
+			}).Err(); err != nil {
+				return moved, err
+			}
+			if err := qr.client.HDel(ctx, legacyName, fields[i]).Err(); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+		if next == 0 {
+			return moved, nil
+		}
+		cursor = next
+	}
+}
+
+// sendToDead records the deliveries in the dead stream with their error history and acks them,
+// lastErr is nil when the deliveries ran out of retries.
+func (qr *QueueRunner) sendToDead(info *QueueInfo, reason string, lastErr error, deliveries ...*Delivery) {
+	if len(deliveries) == 0 {
+		return
+	}
+	handleErrs := qr.loadErrors(info, deliveries)
+	deadMessages := make([]*DeadMessage, 0, len(deliveries))
+	for i, delivery := range deliveries {
+		deadMessage := &DeadMessage{
+			Stream:        delivery.Stream,
+			Group:         info.UserQueueInfo.Group,
+			ID:            delivery.ID,
+			Values:        delivery.Values,
+			Reason:        reason,
+			Errors:        handleErrs[i],
+			RetryCount:    delivery.RetryCount,
+			Consumer:      delivery.Consumer,
+			FirstDelivery: delivery.FirstDelivery,
+			DeadAt:        time.Now(),
+		}
+		if lastErr != nil {
+			deadMessage.Errors = append([]*HandleError{newHandleError(delivery, lastErr)}, deadMessage.Errors...)
+		}
+		if len(deadMessage.Errors) > 0 {
+			deadMessage.LastError = deadMessage.Errors[0].Message
+		}
+		deadMessages = append(deadMessages, deadMessage)
+	}
+
+	if !info.DeadQueueInfo.Stop {
+		pipe := qr.client.Pipeline()
+		cmds := make([]*redis.StringCmd, 0, len(deadMessages))
+		for _, deadMessage := range deadMessages {
+			cmds = append(cmds, pipe.XAdd(qr.ctx, &redis.XAddArgs{
+				Stream: deadStreamName(deadMessage.Stream, deadMessage.Group),
+				ID:     "*",
+				Values: deadValues(deadMessage),
+			}))
+		}
+		if _, err := pipe.Exec(qr.ctx); err != nil {
+			if err != redis.ErrClosed {
+				info.NotifyErr(deliveries[0].Stream, "", err)
+			}
+			return
+		}
+		for i, cmd := range cmds {
+			deadMessages[i].DeadID = cmd.Val()
+			deadMessages[i].DeadAt = idTime(cmd.Val())
+		}
+	}
+	if !qr.ackBatch(info, deliveries, false) {
+		return
+	}
+	for stream, n := range countByStream(deliveries) {
+		qr.metrics.Dead(stream, info.UserQueueInfo.Group, n)
+	}
+	for _, deadMessage := range deadMessages {
+		info.RetryQueueInfo.NotifyDead(deadMessage.Stream, deadMessage.Key(), deadMessage.Val(), deadMessage.ID)
+		info.RetryQueueInfo.NotifyDeadMessage(deadMessage)
+	}
+}
+
+func deadValues(deadMessage *DeadMessage) map[string]any {
+	values, _ := msgpack.Marshal(deadMessage.Values)
+	errs, _ := json.MarshalToString(deadMessage.Errors)
+	var firstDelivery int64
+	if !deadMessage.FirstDelivery.IsZero() {
+		firstDelivery = deadMessage.FirstDelivery.UnixMilli()
+	}
+	return map[string]any{
+		deadIdStr:            deadMessage.ID,
+		deadKeyStr:           deadMessage.Key(),
+		deadValuesStr:        values,
+		deadReasonStr:        deadMessage.Reason,
+		deadErrorStr:         deadMessage.LastError,
+		deadErrorsStr:        errs,
+		deadRetryStr:         deadMessage.RetryCount,
+		deadFirstDeliveryStr: firstDelivery,
+		deadConsumerStr:      deadMessage.Consumer,
+	}
+}
+
+func parseDeadMessage(stream, group string, xMessage redis.XMessage) *DeadMessage {
+	deadMessage := &DeadMessage{
+		DeadID:     xMessage.ID,
+		Stream:     stream,
+		Group:      group,
+		ID:         cast.ToString(xMessage.Values[deadIdStr]),
+		Reason:     cast.ToString(xMessage.Values[deadReasonStr]),
+		LastError:  cast.ToString(xMessage.Values[deadErrorStr]),
+		RetryCount: cast.ToInt64(xMessage.Values[deadRetryStr]),
+		Consumer:   cast.ToString(xMessage.Values[deadConsumerStr]),
+		DeadAt:     idTime(xMessage.ID),
+	}
+	if firstDelivery := cast.ToInt64(xMessage.Values[deadFirstDeliveryStr]); firstDelivery > 0 {
+		deadMessage.FirstDelivery = time.UnixMilli(firstDelivery)
+	}
+	_ = json.UnmarshalFromString(cast.ToString(xMessage.Values[deadErrorsStr]), &deadMessage.Errors)
+	_ = msgpack.Unmarshal([]byte(cast.ToString(xMessage.Values[deadValuesStr])), &deadMessage.Values)
+	if deadMessage.Values == nil {
+		deadMessage.Values = make(map[string]string)
+	}
+	return deadMessage
+}
@@ -0,0 +1,277 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sszqdz/bayes-toolkit/json"
+)
+
+// addDead records a dead message of stream and group and returns its dead ID
+func addDead(t *testing.T, qr *QueueRunner, stream, group, id, key, val string) string {
+	t.Helper()
+	deadId, err := qr.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: deadStreamName(stream, group),
+		ID:     "*",
+		Values: deadValues(&DeadMessage{
+			ID:     id,
+			Values: map[string]string{keyStr: key, valStr: val},
+			Reason: DeadReasonMaxRetry,
+		}),
+	}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deadId
+}
+
+func TestPageDead(t *testing.T) {
+	qr, _ := newRedisRunner(t)
+	ctx := context.Background()
+	for _, id := range []string{"1-0", "2-0", "3-0", "4-0", "5-0"} {
+		addDead(t, qr, "s", "g", id, "k", "v"+id)
+	}
+
+	ids := make([]string, 0, 5)
+	var cursor uint64
+	for {
+		pairs, next, err := qr.PageDead(ctx, "s", "g", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			var xMessage redis.XMessage
+			if err := json.UnmarshalFromString(pairs[i+1], &xMessage); err != nil {
+				t.Fatal(err)
+			}
+			if xMessage.ID != pairs[i] || xMessage.Values[valStr] != "v"+pairs[i] {
+				t.Errorf("pair %s: %+v", pairs[i], xMessage)
+			}
+			ids = append(ids, pairs[i])
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if want := []string{"1-0", "2-0", "3-0", "4-0", "5-0"}; !slices.Equal(ids, want) {
+		t.Errorf("paged %v, want %v", ids, want)
+	}
+}
+
+func TestDeadCursor(t *testing.T) {
+	for _, id := range []string{"1526919030474-0", "1526919030474-55", "1-1048575"} {
+		if got := unpackDeadCursor(packDeadCursor(id)); got != id {
+			t.Errorf("cursor of %q unpacks to %q", id, got)
+		}
+	}
+	if got := unpackDeadCursor(packDeadCursor("7-1048576")); got != "7-0" {
+		t.Errorf("cursor of a large seq unpacks to %q, want 7-0", got)
+	}
+}
+
+func TestHandleDead(t *testing.T) {
+	qr, _ := newRedisRunner(t)
+	ctx := context.Background()
+	addDead(t, qr, "s", "g", "1-0", "a", "v1")
+	addDead(t, qr, "s", "g", "2-0", "b", "v2")
+	deadId := addDead(t, qr, "s", "g", "3-0", "c", "v3")
+
+	errFailed := errors.New("failed")
+	handled := make([]string, 0, 2)
+	errs := qr.HandleDead(ctx, func(stream, key, val, msgId string) error {
+		handled = append(handled, msgId)
+		if key == "b" {
+			return errFailed
+		}
+		return nil
+	}, "s", "g", "1-0", "2-0", "9-0")
+	if len(errs) != 1 || !errors.Is(errs[0], errFailed) {
+		t.Errorf("errs %v, want [%v]", errs, errFailed)
+	}
+	if want := []string{"1-0", "2-0"}; !slices.Equal(handled, want) {
+		t.Errorf("handled %v, want %v", handled, want)
+	}
+
+	// the failed one stays, the handled one is gone
+	deadMessages, _, err := qr.ListDead(ctx, "s", "g", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := make([]string, 0, len(deadMessages))
+	for _, deadMessage := range deadMessages {
+		left = append(left, deadMessage.ID)
+	}
+	if want := []string{"2-0", "3-0"}; !slices.Equal(left, want) {
+		t.Errorf("left %v, want %v", left, want)
+	}
+
+	if errs := qr.HandleDeadByDeadID(ctx, func(stream, key, val, msgId string) error {
+		if msgId != "3-0" || val != "v3" {
+			t.Errorf("handled %s %s", msgId, val)
+		}
+		return nil
+	}, "s", "g", deadId); len(errs) != 0 {
+		t.Errorf("errs %v", errs)
+	}
+}
+
+func TestListAndReplayDead(t *testing.T) {
+	qr, _ := newRedisRunner(t, WithAutoCreateStream())
+	ctx := context.Background()
+	// each message is rejected on its first delivery and handled when replayed
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	handled := make(chan string, 4)
+	consumer := &testConsumer{
+		info: &QueueInfo{UserQueueInfo: &UserQueueInfo{
+			Streams:       []string{"s", ">"},
+			Group:         "g",
+			NewGroupStart: "0",
+			Block:         50 * time.Millisecond,
+		}},
+		consume: func(ctx context.Context, delivery *Delivery) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if !seen[delivery.Val()] {
+				seen[delivery.Val()] = true
+				return fmt.Errorf("bad %s: %w", delivery.Val(), ErrDead)
+			}
+			handled <- delivery.Val()
+			return nil
+		},
+	}
+	for i, key := range []string{"a", "b", "a", "c"} {
+		if _, err := qr.SendWithKey(ctx, "s", key, fmt.Sprint("v", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := qr.RunConsumer(consumer); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, err := qr.client.XLen(ctx, deadStreamName("s", "g")).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dead messages, want 4", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// pages of 3 then 1 through the cursor
+	page, cursor, err := qr.ListDead(ctx, "s", "g", &DeadFilter{Count: 3})
+	if err != nil || len(page) != 3 || cursor == "" {
+		t.Fatalf("first page = %d, %q, %v", len(page), cursor, err)
+	}
+	last, next, err := qr.ListDead(ctx, "s", "g", &DeadFilter{Count: 3, Cursor: cursor})
+	if err != nil || len(last) != 1 || next != "" {
+		t.Fatalf("last page = %d, %q, %v", len(last), next, err)
+	}
+	deadMessages := append(page, last...)
+	for i, deadMessage := range deadMessages {
+		val := fmt.Sprint("v", i)
+		if deadMessage.Val() != val || deadMessage.Reason != DeadReasonRejected || deadMessage.LastError != "bad "+val+": send to dead" {
+			t.Errorf("dead message %d = %+v", i, deadMessage)
+		}
+	}
+
+	byKey, _, err := qr.ListDead(ctx, "s", "g", &DeadFilter{Key: "a"})
+	if err != nil || len(byKey) != 2 || byKey[0].Val() != "v0" || byKey[1].Val() != "v2" {
+		t.Errorf("dead messages of key a = %v, %v", byKey, err)
+	}
+	byErr, _, err := qr.ListDead(ctx, "s", "g", &DeadFilter{ErrContains: "bad v3"})
+	if err != nil || len(byErr) != 1 || byErr[0].Key() != "c" {
+		t.Errorf("dead messages failing with bad v3 = %v, %v", byErr, err)
+	}
+
+	n, err := qr.ReplayDead(ctx, "s", "g", deadMessages[1].DeadID)
+	if err != nil || n != 1 {
+		t.Fatalf("ReplayDead = %d, %v", n, err)
+	}
+	if val := waitHandled(t, handled); val != "v1" {
+		t.Errorf("replayed %s, want v1", val)
+	}
+	if n, err = qr.ReplayDead(ctx, "s", "g"); err != nil || n != 3 {
+		t.Fatalf("ReplayDead of all = %d, %v", n, err)
+	}
+	got := []string{waitHandled(t, handled), waitHandled(t, handled), waitHandled(t, handled)}
+	slices.Sort(got)
+	if want := []string{"v0", "v2", "v3"}; !slices.Equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	if left, _, err := qr.ListDead(ctx, "s", "g", nil); err != nil || len(left) != 0 {
+		t.Errorf("dead messages left %v, %v", left, err)
+	}
+}
+
+func waitHandled(t *testing.T, handled chan string) string {
+	t.Helper()
+	select {
+	case val := <-handled:
+		return val
+	case <-time.After(5 * time.Second):
+		t.Fatal("replayed message not handled")
+		return ""
+	}
+}
+
+func TestCleanDead(t *testing.T) {
+	qr, _ := newRedisRunner(t)
+	ctx := context.Background()
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		addDead(t, qr, "s", "g", id, "", "v")
+	}
+	if n, err := qr.PurgeDead(ctx, "s", "g", 0, 2); err != nil || n != 3 {
+		t.Errorf("PurgeDead = %d, %v, want 3, nil", n, err)
+	}
+	addDead(t, qr, "s", "g", "4-0", "", "v")
+	if err := qr.CleanDead(ctx, "s", "g", 0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if n := qr.client.XLen(ctx, deadStreamName("s", "g")).Val(); n != 0 {
+		t.Errorf("%d dead messages left", n)
+	}
+}
+
+func TestMigrateLegacyDead(t *testing.T) {
+	qr, _ := newRedisRunner(t)
+	ctx := context.Background()
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		data, _ := json.MarshalToString(redis.XMessage{ID: id, Values: map[string]any{keyStr: "k", valStr: "v" + id}})
+		qr.client.HSet(ctx, legacyDeadHashName("s", "g"), id, data)
+	}
+	if n, err := qr.MigrateLegacyDead(ctx, "s", "g", 2); err != nil || n != 3 {
+		t.Fatalf("MigrateLegacyDead = %d, %v, want 3, nil", n, err)
+	}
+	if n := qr.client.Exists(ctx, legacyDeadHashName("s", "g")).Val(); n != 0 {
+		t.Error("legacy hash left")
+	}
+	deadMessages, _, err := qr.ListDead(ctx, "s", "g", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadMessages) != 3 {
+		t.Fatalf("%d dead messages, want 3", len(deadMessages))
+	}
+	for _, deadMessage := range deadMessages {
+		if deadMessage.Key() != "k" || deadMessage.Val() != "v"+deadMessage.ID || deadMessage.Reason != DeadReasonMaxRetry {
+			t.Errorf("dead message %+v", deadMessage)
+		}
+	}
+}
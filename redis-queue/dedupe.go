@@ -0,0 +1,162 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	dedupeProcessing = "processing"
+	dedupeDone       = "done"
+)
+
+// DedupeQueueInfo skips messages that were handled successfully before,
+// e.g. redelivered because the ack failed, or sent twice with the same key.
+// Before handling, a message takes a lease, after success the lease is replaced
+// by a done mark kept for TTL, and messages found done are acked without handling.
+type DedupeQueueInfo struct {
+	// UseIdempotencyKey dedupes by the idempotency key of SendIdempotent or Entry instead of
+	// the message ID, messages without one still use their ID. The key of SendWithKey is not
+	// used, it orders and partitions the messages of an entity rather than identifying one.
+	UseIdempotencyKey bool
+	// TTL is how long a handled message is remembered
+	TTL time.Duration
+	// LeaseTTL bounds how long a message is locked while being handled, it defaults to
+	// UserQueueInfo.HandleTimeout or 1m. Messages of a crashed consumer are not handled again
+	// before their lease expires, so it should not exceed RetryQueueInfo.MinIdleTime.
+	LeaseTTL time.Duration
+	// NotifyDuplicate is called for each skipped message,
+	// done tells whether it was handled before or is being handled by another consumer.
+	NotifyDuplicate func(delivery *Delivery, done bool)
+}
+
+func checkDedupeQueueInfo(info *QueueInfo) {
+	dedupeQueueInfo := info.DedupeQueueInfo
+	if dedupeQueueInfo == nil {
+		return
+	}
+	if dedupeQueueInfo.TTL < 0 {
+		panic("invalid dedupe ttl")
+	}
+	if dedupeQueueInfo.TTL == 0 {
+		dedupeQueueInfo.TTL = 24 * time.Hour
+	}
+	if dedupeQueueInfo.LeaseTTL < 0 {
+		panic("invalid dedupe lease ttl")
+	}
+	if dedupeQueueInfo.LeaseTTL == 0 {
+		dedupeQueueInfo.LeaseTTL = info.UserQueueInfo.HandleTimeout
+	}
+	if dedupeQueueInfo.LeaseTTL == 0 {
+		dedupeQueueInfo.LeaseTTL = time.Minute
+	}
+	if dedupeQueueInfo.NotifyDuplicate == nil {
+		dedupeQueueInfo.NotifyDuplicate = func(delivery *Delivery, done bool) {}
+	}
+}
+
+func dedupeName(info *QueueInfo, delivery *Delivery) string {
+	id := delivery.ID
+	if info.DedupeQueueInfo.UseIdempotencyKey && delivery.IdempotencyKey() != "" {
+		id = delivery.IdempotencyKey()
+	}
+	return dedupeKeyName(delivery.Stream, info.UserQueueInfo.Group, id)
+}
+
+// dedupe takes the leases of the deliveries and returns the ones to handle,
+// those handled before are acked, those leased by another consumer stay pending.
+func (qr *QueueRunner) dedupe(info *QueueInfo, deliveries []*Delivery) []*Delivery {
+	if info.DedupeQueueInfo == nil || len(deliveries) == 0 {
+		return deliveries
+	}
+	pipe := qr.client.Pipeline()
+	leaseCmds := make([]*redis.BoolCmd, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		leaseCmds = append(leaseCmds, pipe.SetNX(qr.ctx, dedupeName(info, delivery), dedupeProcessing, info.DedupeQueueInfo.LeaseTTL))
+	}
+	if _, err := pipe.Exec(qr.ctx); err != nil {
+		// nothing is handled without a lease, the messages stay pending
+		if err != redis.ErrClosed {
+			info.NotifyErr(deliveries[0].Stream, "", err)
+		}
+		return nil
+	}
+
+	leased := make([]*Delivery, 0, len(deliveries))
+	conflicts := make([]*Delivery, 0)
+	for i, delivery := range deliveries {
+		if leaseCmds[i].Val() {
+			leased = append(leased, delivery)
+			continue
+		}
+		conflicts = append(conflicts, delivery)
+	}
+	if len(conflicts) == 0 {
+		return leased
+	}
+
+	pipe = qr.client.Pipeline()
+	getCmds := make([]*redis.StringCmd, 0, len(conflicts))
+	for _, delivery := range conflicts {
+		getCmds = append(getCmds, pipe.Get(qr.ctx, dedupeName(info, delivery)))
+	}
+	if _, err := pipe.Exec(qr.ctx); err != nil && err != redis.Nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(conflicts[0].Stream, "", err)
+		}
+		return leased
+	}
+	done := make([]*Delivery, 0, len(conflicts))
+	for i, delivery := range conflicts {
+		isDone := getCmds[i].Val() == dedupeDone
+		if isDone {
+			done = append(done, delivery)
+		}
+		info.DedupeQueueInfo.NotifyDuplicate(delivery, isDone)
+	}
+	qr.ackBatch(info, done, false)
+	return leased
+}
+
+// dedupeDoneTries bounds the writes of the done mark after a success
+const dedupeDoneTries = 3
+
+// markDedupeDone marks the deliveries as handled before their XACK, on its own and retried,
+// so a connection lost around the ack leads to a skipped redelivery instead of a second handling.
+func (qr *QueueRunner) markDedupeDone(info *QueueInfo, deliveries []*Delivery) {
+	if info.DedupeQueueInfo == nil {
+		return
+	}
+	var err error
+	for try := 1; try <= dedupeDoneTries; try++ {
+		pipe := qr.client.Pipeline()
+		for _, delivery := range deliveries {
+			pipe.Set(qr.ctx, dedupeName(info, delivery), dedupeDone, info.DedupeQueueInfo.TTL)
+		}
+		if _, err = pipe.Exec(qr.ctx); err == nil || err == redis.ErrClosed {
+			return
+		}
+		if try < dedupeDoneTries {
+			qr.sleep(time.Duration(try) * 100 * time.Millisecond)
+		}
+	}
+	info.NotifyErr(deliveries[0].Stream, "", err)
+}
+
+// releaseDedupe drops the lease of a failed delivery so it can be handled again
+func (qr *QueueRunner) releaseDedupe(info *QueueInfo, delivery *Delivery) {
+	if info.DedupeQueueInfo == nil {
+		return
+	}
+	if _, err := qr.client.Del(qr.ctx, dedupeName(info, delivery)).Result(); err != nil {
+		if err == redis.ErrClosed {
+			return
+		}
+		info.NotifyErr(delivery.Stream, delivery.Key(), err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sourcegraph/conc"
+	"github.com/spf13/cast"
+	"github.com/sszqdz/bayes-toolkit/rrand"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// SendAt parks the message until at, then a RunDelay loop adds it to the stream.
+// key may be empty, the returned id identifies the parked message, not the stream entry.
+func (qr *QueueRunner) SendAt(ctx context.Context, stream string, at time.Time, key, val string) (string, error) {
+	if stream == "" || val == "" {
+		return "", errors.New("invalid params")
+	}
+	stream = qr.route(stream, key)
+	fields := []string{valStr, val}
+	if key != "" {
+		fields = append(fields, keyStr, key)
+	}
+	data, err := msgpack.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+
+	id := cast.ToString(at.UnixMilli()) + "-" + rrand.RandStr(16)
+	pipe := qr.client.TxPipeline()
+	pipe.HSet(ctx, delayHashName(stream), id, data)
+	pipe.ZAdd(ctx, delayZSetName(stream), redis.Z{Score: float64(at.UnixMilli()), Member: id})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (qr *QueueRunner) SendAfter(ctx context.Context, stream string, d time.Duration, key, val string) (string, error) {
+	return qr.SendAt(ctx, stream, time.Now().Add(d), key, val)
+}
+
+type DelayInfo struct {
+	// Streams may list topics of WithPartitionedTopic, which stand for all their partitions
+	Streams   []string
+	Tick      time.Duration
+	BatchSize int64
+	NotifyErr func(stream string, err error)
+}
+
+// RunDelay moves due delayed messages of the streams into them until the runner is closed
+func (qr *QueueRunner) RunDelay(delayInfos ...*DelayInfo) error {
+	for _, delayInfo := range delayInfos {
+		checkDelayInfo(delayInfo)
+		// SendAt parks the messages of a topic under their partition
+		delayInfo.Streams = qr.partitionStreams(delayInfo.Streams)
+	}
+	return qr.spawn(func(wg *conc.WaitGroup) {
+		for _, delayInfo := range delayInfos {
+			wg.Go(func() {
+				tick := time.NewTicker(delayInfo.Tick)
+				for {
+					select {
+					case <-qr.closeChan:
+						tick.Stop()
+						return
+					case <-tick.C:
+						if qr.IsLeader() {
+							qr.delayRun(qr.ctx, delayInfo)
+						}
+					}
+				}
+			})
+		}
+	})
+}
+
+func checkDelayInfo(info *DelayInfo) {
+	if info == nil {
+		panic("nil delay info")
+	}
+	if len(info.Streams) == 0 {
+		panic("empty streams")
+	}
+	for _, stream := range info.Streams {
+		if stream == "" {
+			panic("empty stream")
+		}
+	}
+	if info.Tick < 0 {
+		panic("invalid tick")
+	}
+	if info.Tick == 0 {
+		info.Tick = time.Second
+	}
+	if info.BatchSize < 0 {
+		panic("invalid batch size")
+	}
+	if info.BatchSize == 0 {
+		info.BatchSize = 100
+	}
+	if info.NotifyErr == nil {
+		info.NotifyErr = func(stream string, err error) {}
+	}
+}
+
+func (qr *QueueRunner) delayRun(ctx context.Context, delayInfo *DelayInfo) {
+	for _, stream := range delayInfo.Streams {
+		for !qr.closing.Load() {
+			mkStream := "0"
+			if qr.mkStream {
+				mkStream = "1"
+			}
+			keys := []string{delayZSetName(stream), delayHashName(stream), stream}
+			result, err := qr.evalScript(ctx, scriptMoveDelayed, keys, time.Now().UnixMilli(), delayInfo.BatchSize, mkStream)
+			if err != nil {
+				if err != redis.ErrClosed {
+					delayInfo.NotifyErr(stream, err)
+				}
+				break
+			}
+			results, _ := result.([]any)
+			if len(results) != 2 {
+				delayInfo.NotifyErr(stream, errors.New("unexpected script result"))
+				break
+			}
+			// the due messages stay parked until the stream is created
+			if cast.ToInt64(results[1]) == 1 {
+				delayInfo.NotifyErr(stream, ErrStreamNotFound)
+				break
+			}
+			// drain the stream while full batches are moved
+			if cast.ToInt64(results[0]) < delayInfo.BatchSize {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cast"
+)
+
+type Delivery struct {
+	Stream   string
+	ID       string
+	Group    string
+	Consumer string
+	Values   map[string]string
+	// RetryCount is the number of times the message was delivered before this delivery
+	RetryCount int64
+	// FirstDelivery is zero when the message is redelivered and its first delivery is unknown,
+	// e.g. the consumer that received it died before handling it.
+	FirstDelivery time.Time
+}
+
+func (d *Delivery) Key() string {
+	return d.Values[keyStr]
+}
+
+func (d *Delivery) Val() string {
+	return d.Values[valStr]
+}
+
+func (d *Delivery) ContentType() string {
+	return d.Values[ctStr]
+}
+
+// IdempotencyKey is the key given to SendIdempotent or Entry, empty otherwise
+func (d *Delivery) IdempotencyKey() string {
+	return d.Values[idemStr]
+}
+
+type Handler func(ctx context.Context, delivery *Delivery) error
+
+// IConsumer is the context-aware counterpart of IQueue.
+// The ctx passed to Consume is cancelled when Shutdown gives up waiting,
+// and carries UserQueueInfo.HandleTimeout as its deadline.
+type IConsumer interface {
+	Info() *QueueInfo
+	Consume(ctx context.Context, delivery *Delivery) error
+}
+
+type queueConsumer struct {
+	IQueue
+}
+
+func (c queueConsumer) Consume(ctx context.Context, delivery *Delivery) error {
+	return c.Handle(delivery.Stream, delivery.Key(), delivery.Val(), delivery.ID)
+}
+
+func newDelivery(info *QueueInfo, consumer, stream string, xMessage redis.XMessage) *Delivery {
+	values := make(map[string]string, len(xMessage.Values))
+	for k, v := range xMessage.Values {
+		values[k] = cast.ToString(v)
+	}
+	return &Delivery{
+		Stream:   stream,
+		ID:       xMessage.ID,
+		Group:    info.UserQueueInfo.Group,
+		Consumer: consumer,
+		Values:   values,
+	}
+}
+
+func (qr *QueueRunner) process(info *QueueInfo, deliveries []*Delivery) {
+	qr.processOnce(info, deliveries)
+	// ordered keys whose next message was claimed by an ack
+	for promoted := info.control.takePromoted(); len(promoted) > 0; promoted = info.control.takePromoted() {
+		qr.takeAll(info, len(promoted))
+		qr.processOnce(info, promoted)
+	}
+}
+
+func (qr *QueueRunner) processOnce(info *QueueInfo, deliveries []*Delivery) {
+	deliveries = qr.order(info, deliveries)
+	deliveries = qr.dedupe(info, deliveries)
+	if info.batchHandler != nil {
+		qr.processBatch(info, deliveries)
+		return
+	}
+	for _, delivery := range deliveries {
+		if !qr.limit(info, delivery) {
+			continue
+		}
+		if err := qr.handle(info, delivery); err != nil {
+			qr.fail(info, delivery, err)
+			continue
+		}
+		qr.ack(info, delivery)
+	}
+}
+
+func (qr *QueueRunner) handle(info *QueueInfo, delivery *Delivery) error {
+	ctx, cancel := qr.handleContext(info)
+	defer cancel()
+
+	start := time.Now()
+	err := info.handler(ctx, delivery)
+	qr.metrics.Handled(delivery.Stream, info.UserQueueInfo.Group, time.Since(start), err)
+	return err
+}
+
+func (qr *QueueRunner) handleContext(info *QueueInfo) (context.Context, context.CancelFunc) {
+	if info.UserQueueInfo.HandleTimeout > 0 {
+		return context.WithTimeout(qr.ctx, info.UserQueueInfo.HandleTimeout)
+	}
+	return qr.ctx, func() {}
+}
+
+// fail notifies the error, then either sends the message to the dead store
+// or leaves it pending for the retry loop
+func (qr *QueueRunner) fail(info *QueueInfo, delivery *Delivery, err error) {
+	info.NotifyErr(delivery.Stream, delivery.Key(), err)
+	qr.releaseDedupe(info, delivery)
+	if errors.Is(err, ErrDead) {
+		qr.sendToDead(info, DeadReasonRejected, err, delivery)
+		return
+	}
+	qr.markFailed(info, delivery, err)
+}
+
+func (qr *QueueRunner) ack(info *QueueInfo, delivery *Delivery) bool {
+	// the done mark is written before the XACK, ordered keys move on after it
+	if info.DedupeQueueInfo != nil || info.UserQueueInfo.Ordered {
+		return qr.ackBatch(info, []*Delivery{delivery}, true)
+	}
+	if _, err := qr.client.XAck(qr.ctx, delivery.Stream, info.UserQueueInfo.Group, delivery.ID).Result(); err != nil {
+		info.NotifyErr(delivery.Stream, delivery.Key(), err)
+		return false
+	}
+	qr.metrics.Acked(delivery.Stream, info.UserQueueInfo.Group, 1)
+	if delivery.RetryCount > 0 {
+		qr.clearMeta(info, delivery.Stream, delivery.ID)
+	}
+	return true
+}
+
+// markFailed remembers the first delivery time of a message that will be redelivered,
+// and schedules the redelivery when the retry policy or the error asks for a delay.
+func (qr *QueueRunner) markFailed(info *QueueInfo, delivery *Delivery, err error) {
+	if info.RetryQueueInfo.Stop {
+		return
+	}
+	firstDelivery := delivery.FirstDelivery
+	if firstDelivery.IsZero() {
+		firstDelivery = time.Now()
+	}
+	pipe := qr.client.Pipeline()
+	pipe.HSetNX(qr.ctx, metaHashName(delivery.Stream, info.UserQueueInfo.Group), delivery.ID, firstDelivery.UnixMilli())
+	qr.pipeRecordError(pipe, info, delivery, err)
+	if delay, ok := info.RetryQueueInfo.nextDelay(delivery.RetryCount+1, err); ok {
+		pipe.ZAdd(qr.ctx, retryZSetName(delivery.Stream, info.UserQueueInfo.Group), redis.Z{
+			Score:  float64(time.Now().Add(delay).UnixMilli()),
+			Member: delivery.ID,
+		})
+	}
+	if _, err := pipe.Exec(qr.ctx); err != nil {
+		if err == redis.ErrClosed {
+			return
+		}
+		info.NotifyErr(delivery.Stream, delivery.Key(), err)
+	}
+}
+
+// loadFirstDeliveries fills FirstDelivery of redelivered messages
+func (qr *QueueRunner) loadFirstDeliveries(info *QueueInfo, stream string, deliveries []*Delivery) {
+	if len(deliveries) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		ids = append(ids, delivery.ID)
+	}
+	results, err := qr.client.HMGet(qr.ctx, metaHashName(stream, info.UserQueueInfo.Group), ids...).Result()
+	if err != nil {
+		if err == redis.ErrClosed {
+			return
+		}
+		info.NotifyErr(stream, "", err)
+		return
+	}
+	for i, result := range results {
+		if result == nil {
+			continue
+		}
+		deliveries[i].FirstDelivery = time.UnixMilli(cast.ToInt64(result))
+	}
+}
+
+// clearMeta removes what was recorded for redelivered messages
+func (qr *QueueRunner) clearMeta(info *QueueInfo, stream string, ids ...string) {
+	if len(ids) == 0 {
+		return
+	}
+	pipe := qr.client.Pipeline()
+	qr.pipeClearMeta(pipe, info, stream, ids...)
+	if _, err := pipe.Exec(qr.ctx); err != nil {
+		if err == redis.ErrClosed {
+			return
+		}
+		info.NotifyErr(stream, "", err)
+	}
+}
+
+func (qr *QueueRunner) pipeClearMeta(pipe redis.Pipeliner, info *QueueInfo, stream string, ids ...string) {
+	pipe.HDel(qr.ctx, metaHashName(stream, info.UserQueueInfo.Group), ids...)
+	errorNames := make([]string, 0, len(ids))
+	for _, id := range ids {
+		errorNames = append(errorNames, errorListName(stream, info.UserQueueInfo.Group, id))
+	}
+	pipe.Del(qr.ctx, errorNames...)
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sszqdz/bayes-toolkit/json"
+)
+
+// HandleError is one failed handling of a message, the newest is kept first
+type HandleError struct {
+	Message  string    `json:"message"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Consumer string    `json:"consumer"`
+}
+
+func newHandleError(delivery *Delivery, err error) *HandleError {
+	return &HandleError{
+		Message:  err.Error(),
+		Type:     fmt.Sprintf("%T", err),
+		Time:     time.Now(),
+		Consumer: delivery.Consumer,
+	}
+}
+
+// pipeRecordError keeps the last ErrorHistory errors of a pending message
+func (qr *QueueRunner) pipeRecordError(pipe redis.Pipeliner, info *QueueInfo, delivery *Delivery, err error) {
+	if info.RetryQueueInfo.ErrorHistory == 0 {
+		return
+	}
+	errStr, _ := json.MarshalToString(newHandleError(delivery, err))
+	name := errorListName(delivery.Stream, info.UserQueueInfo.Group, delivery.ID)
+	pipe.LPush(qr.ctx, name, errStr)
+	pipe.LTrim(qr.ctx, name, 0, info.RetryQueueInfo.ErrorHistory-1)
+	pipe.Expire(qr.ctx, name, info.RetryQueueInfo.ErrorHistoryTTL)
+}
+
+// loadErrors returns the recorded errors of each delivery
+func (qr *QueueRunner) loadErrors(info *QueueInfo, deliveries []*Delivery) [][]*HandleError {
+	errs := make([][]*HandleError, len(deliveries))
+	if info.RetryQueueInfo.ErrorHistory == 0 {
+		return errs
+	}
+	pipe := qr.client.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		cmds = append(cmds, pipe.LRange(qr.ctx, errorListName(delivery.Stream, info.UserQueueInfo.Group, delivery.ID), 0, -1))
+	}
+	if _, err := pipe.Exec(qr.ctx); err != nil && err != redis.Nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(deliveries[0].Stream, "", err)
+		}
+		return errs
+	}
+	for i, cmd := range cmds {
+		for _, errStr := range cmd.Val() {
+			var handleErr *HandleError
+			if err := json.UnmarshalFromString(errStr, &handleErr); err != nil || handleErr == nil {
+				continue
+			}
+			errs[i] = append(errs[i], handleErr)
+		}
+	}
+	return errs
+}
@@ -5,31 +5,71 @@
 package redisqueue
 
 import (
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/sourcegraph/conc"
 )
 
 type QueueInfo struct {
+	// Name identifies the queue to Pause, Resume, Drain, Remove and SetConsumerSize,
+	// it is unique in a runner. It defaults to "<Group>:<stream>,<stream>...",
+	// or "<Group>:<Topic>" with PartitionInfo.
+	Name           string
 	UserQueueInfo  *UserQueueInfo
 	RetryQueueInfo *RetryQueueInfo
 	DeadQueueInfo  *DeadQueueInfo
-	NotifyErr      func(stream, key string, err error)
-	NotifyPanic    func(pnc any, stack string)
+	// DedupeQueueInfo is optional, nil means no deduplication
+	DedupeQueueInfo *DedupeQueueInfo
+	// Limiter is optional, it paces the reads instead of failing messages
+	Limiter Limiter
+	// PartitionInfo is optional, it replaces UserQueueInfo.Streams with the partitions of a topic
+	PartitionInfo *PartitionInfo
+	NotifyErr     func(stream, key string, err error)
+	NotifyPanic   func(pnc any, stack string)
 
-	wg      *conc.WaitGroup
-	handler HandleFunc
+	control      *queueControl
+	exclusive    bool // run by one runner at a time, e.g. a partition, so its retry loop ignores the leader
+	handler      Handler
+	batchHandler BatchHandler
 }
 
 type UserQueueInfo struct {
-	Streams       []string
+	Streams []string
+	// Tiers replace Streams when streams have priorities, the first tier is the most urgent.
+	// Lower tiers are read when higher ones are empty, or in turn when tiers have weights.
+	Tiers         []*StreamTier
 	Group         string
 	ConsumerSize  int
 	BatchSize     int64
 	NewGroupStart string
+	// Block is how long a read waits for new messages,
+	// it also bounds how long Shutdown waits for an idle consumer.
+	Block time.Duration
+	// ConsumerPrefix defaults to Group, consumer names are
+	// <prefix>-<hostname>-<pid>-<index> so each goroutine of each process is distinguishable.
+	ConsumerPrefix string
+	// HandleTimeout is the deadline of the context passed to the handler, zero means no deadline
+	HandleTimeout time.Duration
+	// WorkerSize is the max number of messages each consumer handles at the same time,
+	// messages sharing a key are handled in order by the same worker.
+	WorkerSize int
+	// WorkerBuffer is the number of messages queued for each busy worker before reading blocks,
+	// queued messages are claimed again every RetryQueueInfo.MinIdleTime/2 so they are not retried,
+	// which leaves a handler at least MinIdleTime/2 once its worker takes the message.
+	WorkerBuffer int
+	// StaleConsumerIdle is how long a consumer without pending messages may stay idle
+	// before the retry loop deletes it from the group.
+	StaleConsumerIdle time.Duration
+	// Ordered handles the messages sharing a key one at a time in ID order across all consumers
+	// and processes, a failed message holds back its key until it is acked or dead.
+	// Messages without key are not ordered. It excludes Tiers, batch handlers and RetryQueueInfo.Stop.
+	Ordered bool
 
-	streams  []string // only stream names
-	consumer string
+	streams     []string // only stream names
+	consumer    string   // consumer name without index
+	consumers   []string
+	tiered      bool // Streams are filled from Tiers
+	partitioned bool // Streams are filled from PartitionInfo
 }
 
 type RetryQueueInfo struct {
@@ -39,6 +79,22 @@ type RetryQueueInfo struct {
 	MinIdleTime time.Duration
 	BatchSize   int64
 	NotifyDead  func(stream, key, val, msgId string)
+	// NotifyDeadMessage is called along with NotifyDead with the whole dead message,
+	// its DeadID is empty when DeadQueueInfo.Stop is set.
+	NotifyDeadMessage func(deadMessage *DeadMessage)
+	// Policy schedules the redelivery of failed messages, nil means redelivering
+	// once they stay pending longer than MinIdleTime. Tick bounds the precision.
+	Policy RetryPolicy
+	// ErrorHistory is the number of handler errors kept for each pending message
+	// and attached to its dead message, they expire after ErrorHistoryTTL.
+	ErrorHistory    int64
+	ErrorHistoryTTL time.Duration
+	// MaxPerTick bounds the idle pending messages examined per stream each tick,
+	// the next tick goes on with the newer ones.
+	MaxPerTick int64
+	// NotifyDeleted is called for each pending message found deleted from the stream,
+	// it is acked and forgotten.
+	NotifyDeleted func(stream, id string)
 
 	consumer string
 }
@@ -52,6 +108,8 @@ func checkQueueInfo(info *QueueInfo) {
 		panic("nil queue info")
 	}
 	userQueueInfo := info.UserQueueInfo
+	checkTiers(userQueueInfo)
+	checkPartitionInfo(info)
 	if len(userQueueInfo.Streams) == 0 {
 		panic("empty streams")
 	}
@@ -78,11 +136,45 @@ func checkQueueInfo(info *QueueInfo) {
 	if userQueueInfo.BatchSize == 0 {
 		userQueueInfo.BatchSize = 1
 	}
+	if userQueueInfo.Block < 0 {
+		panic("invalid block")
+	}
+	if userQueueInfo.Block == 0 {
+		userQueueInfo.Block = 2 * time.Second
+	}
+	if userQueueInfo.WorkerSize < 0 {
+		panic("invalid worker size")
+	}
+	if userQueueInfo.WorkerSize == 0 {
+		userQueueInfo.WorkerSize = 1
+	}
+	if userQueueInfo.WorkerBuffer < 0 {
+		panic("invalid worker buffer")
+	}
+	if userQueueInfo.WorkerBuffer == 0 {
+		userQueueInfo.WorkerBuffer = int(userQueueInfo.BatchSize)
+	}
+	if userQueueInfo.HandleTimeout < 0 {
+		panic("invalid handle timeout")
+	}
 	if userQueueInfo.NewGroupStart == "" {
 		userQueueInfo.NewGroupStart = "$"
 	}
+	if userQueueInfo.ConsumerPrefix == "" {
+		userQueueInfo.ConsumerPrefix = userQueueInfo.Group
+	}
+	if userQueueInfo.StaleConsumerIdle < 0 {
+		panic("invalid stale consumer idle")
+	}
+	if userQueueInfo.StaleConsumerIdle == 0 {
+		userQueueInfo.StaleConsumerIdle = time.Hour
+	}
 	userQueueInfo.streams = extractStreamNames(userQueueInfo.Streams)
-	userQueueInfo.consumer = userQueueInfo.Group + "-consumer"
+	userQueueInfo.consumer = consumerName(userQueueInfo.ConsumerPrefix)
+	userQueueInfo.consumers = make([]string, 0, userQueueInfo.ConsumerSize)
+	for i := 0; i < userQueueInfo.ConsumerSize; i++ {
+		userQueueInfo.consumers = append(userQueueInfo.consumers, userQueueInfo.consumer+"-"+strconv.Itoa(i))
+	}
 	if info.RetryQueueInfo == nil {
 		info.RetryQueueInfo = &RetryQueueInfo{}
 	}
@@ -112,19 +204,58 @@ func checkQueueInfo(info *QueueInfo) {
 		if retryQueueInfo.BatchSize == 0 {
 			retryQueueInfo.BatchSize = 10
 		}
-		if retryQueueInfo.NotifyDead == nil {
-			retryQueueInfo.NotifyDead = func(stream, key, val, msgId string) {}
+		if retryQueueInfo.ErrorHistory < 0 {
+			panic("invalid error history")
 		}
+		if retryQueueInfo.ErrorHistory == 0 {
+			retryQueueInfo.ErrorHistory = 5
+		}
+		if retryQueueInfo.ErrorHistoryTTL < 0 {
+			panic("invalid error history ttl")
+		}
+		if retryQueueInfo.ErrorHistoryTTL == 0 {
+			retryQueueInfo.ErrorHistoryTTL = 7 * 24 * time.Hour
+		}
+		if retryQueueInfo.MaxPerTick < 0 {
+			panic("invalid max per tick")
+		}
+		if retryQueueInfo.MaxPerTick == 0 {
+			retryQueueInfo.MaxPerTick = 100 * retryQueueInfo.BatchSize
+		}
+		if retryQueueInfo.NotifyDeleted == nil {
+			retryQueueInfo.NotifyDeleted = func(stream, id string) {}
+		}
+	}
+	// rejected and undecodable messages are dead even when the retry loop is stopped
+	if retryQueueInfo.NotifyDead == nil {
+		retryQueueInfo.NotifyDead = func(stream, key, val, msgId string) {}
+	}
+	if retryQueueInfo.NotifyDeadMessage == nil {
+		retryQueueInfo.NotifyDeadMessage = func(deadMessage *DeadMessage) {}
 	}
 	retryQueueInfo.consumer = userQueueInfo.consumer + "-retry"
 	if info.DeadQueueInfo == nil {
 		info.DeadQueueInfo = &DeadQueueInfo{}
 	}
+	checkDedupeQueueInfo(info)
 	if info.NotifyErr == nil {
 		info.NotifyErr = func(stream, key string, err error) {}
 	}
 	if info.NotifyPanic == nil {
 		info.NotifyPanic = func(pnc any, stack string) {}
 	}
-	info.wg = conc.NewWaitGroup()
+	if info.Name == "" {
+		info.Name = defaultQueueName(info)
+	}
+	// kept when a removed queue is run again
+	if info.control == nil {
+		info.control = newQueueControl()
+	}
+}
+
+func defaultQueueName(info *QueueInfo) string {
+	if info.PartitionInfo != nil {
+		return info.UserQueueInfo.Group + ":" + info.PartitionInfo.Topic
+	}
+	return info.UserQueueInfo.Group + ":" + strings.Join(info.UserQueueInfo.streams, ",")
 }
@@ -0,0 +1,91 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sourcegraph/conc"
+	redislock "github.com/sszqdz/bayes-toolkit/redis-lock"
+	"github.com/sszqdz/bayes-toolkit/rrand"
+)
+
+// leader elects one runner among the processes sharing the key
+type leader struct {
+	key     string
+	token   string
+	ttl     time.Duration
+	notify  func(leader bool, err error)
+	elected atomic.Bool
+}
+
+// WithLeaderElection makes the retry, trim and delay loops run only in the runner holding
+// the lease on key, the others take over within ttl once it stops renewing.
+// notify is optional, it is called when the runner gains or loses the lease and on errors.
+func WithLeaderElection(key string, ttl time.Duration, notify func(leader bool, err error)) Option {
+	if key == "" {
+		panic("empty leader key")
+	}
+	if ttl <= 0 {
+		panic("invalid leader ttl")
+	}
+	if notify == nil {
+		notify = func(leader bool, err error) {}
+	}
+	return func(qr *QueueRunner) {
+		qr.leader = &leader{
+			key:    key,
+			token:  consumerName("leader") + "-" + rrand.RandStr(8),
+			ttl:    ttl,
+			notify: notify,
+		}
+	}
+}
+
+// IsLeader tells whether the runner runs the background loops, always true without election
+func (qr *QueueRunner) IsLeader() bool {
+	return qr.leader == nil || qr.leader.elected.Load()
+}
+
+// runLeader renews the lease every ttl/3 until the runner is closed, then releases it
+func (qr *QueueRunner) runLeader() {
+	l := qr.leader
+	// the runner is not closing yet, it is being created
+	_ = qr.spawn(func(wg *conc.WaitGroup) {
+		wg.Go(func() {
+			var renewed time.Time
+			tick := time.NewTicker(l.ttl / 3)
+			defer tick.Stop()
+			for {
+				ok, err := redislock.TryLeaseWith(qr.ctx, qr.client, l.key, l.token, l.ttl)
+				if err != nil {
+					l.notify(l.elected.Load(), err)
+					// the lease may still be ours until it expires
+					if time.Since(renewed) >= l.ttl && l.elected.CompareAndSwap(true, false) {
+						l.notify(false, nil)
+					}
+				} else {
+					if ok {
+						renewed = time.Now()
+					}
+					if l.elected.Swap(ok) != ok {
+						l.notify(ok, nil)
+					}
+				}
+
+				select {
+				case <-qr.closeChan:
+					if l.elected.Swap(false) {
+						_, err := redislock.ReleaseLeaseWith(qr.ctx, qr.client, l.key, l.token)
+						l.notify(false, err)
+					}
+					return
+				case <-tick.C:
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,300 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cast"
+)
+
+// Limiter bounds how fast a queue handles messages, the consumer does not read while it waits.
+// Take is called before each read, it waits for at least one token and takes up to n,
+// the read is capped at the tokens taken so read messages do not wait in memory.
+// Return gives back the tokens of a read that got fewer messages, e.g. an empty one.
+// Wait is called before handling each message for limits depending on its key,
+// the message is kept claimed meanwhile so the retry loop does not take it.
+type Limiter interface {
+	Take(ctx context.Context, n int) (int, error)
+	Return(ctx context.Context, n int) error
+	Wait(ctx context.Context, key string) error
+}
+
+// LocalLimiter is a token bucket of one process, refilled with rate tokens per second up to burst.
+// With perKey each message key has its own bucket.
+type LocalLimiter struct {
+	interval time.Duration
+	burst    int
+	perKey   bool
+
+	mu      sync.Mutex
+	tats    map[string]time.Time // when the bucket is full again
+	sweepAt int
+}
+
+var _ Limiter = (*LocalLimiter)(nil)
+
+func NewLocalLimiter(rate float64, burst int, perKey bool) *LocalLimiter {
+	if rate <= 0 {
+		panic("invalid rate")
+	}
+	if burst <= 0 {
+		panic("invalid burst")
+	}
+	return &LocalLimiter{
+		interval: time.Duration(float64(time.Second) / rate),
+		burst:    burst,
+		perKey:   perKey,
+		tats:     make(map[string]time.Time),
+		sweepAt:  1024,
+	}
+}
+
+// Take takes up to n tokens of the bucket, with perKey it takes none and returns 1,
+// so the consumer reads one message at a time and Wait takes the token of its key.
+func (l *LocalLimiter) Take(ctx context.Context, n int) (int, error) {
+	if l.perKey {
+		return 1, nil
+	}
+	return l.take(ctx, "", n)
+}
+
+// Return puts back up to n tokens taken by Take, with perKey it does nothing
+func (l *LocalLimiter) Return(ctx context.Context, n int) error {
+	if l.perKey || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	tat := l.tats[""].Add(-l.interval * time.Duration(n))
+	if tat.After(now) {
+		l.tats[""] = tat
+	} else {
+		delete(l.tats, "")
+	}
+	return nil
+}
+
+// Wait takes a token of the bucket of the key, without perKey it returns at once
+// as the tokens are taken by Take.
+func (l *LocalLimiter) Wait(ctx context.Context, key string) error {
+	if !l.perKey {
+		return nil
+	}
+	_, err := l.take(ctx, key, 1)
+	return err
+}
+
+func (l *LocalLimiter) take(ctx context.Context, key string, n int) (int, error) {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		tat := l.tats[key]
+		if tat.Before(now) {
+			tat = now
+		}
+		available := l.burst - int((tat.Sub(now)+l.interval-1)/l.interval)
+		if available > 0 {
+			taken := min(n, available)
+			l.tats[key] = tat.Add(l.interval * time.Duration(taken))
+			l.sweep(now)
+			l.mu.Unlock()
+			return taken, nil
+		}
+		delay := tat.Sub(now) - l.interval*time.Duration(l.burst-1)
+		l.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// sweep drops the full buckets once there are many keys
+func (l *LocalLimiter) sweep(now time.Time) {
+	if len(l.tats) < l.sweepAt {
+		return
+	}
+	for key, tat := range l.tats {
+		if !tat.After(now) {
+			delete(l.tats, key)
+		}
+	}
+	l.sweepAt = max(2*len(l.tats), 1024)
+}
+
+// RedisLimiter is a token bucket shared by all processes using the same name,
+// refilled with rate tokens per second up to burst. With perKey each message key has its own bucket.
+type RedisLimiter struct {
+	qr       *QueueRunner
+	name     string
+	interval float64 // ms
+	burst    int
+	perKey   bool
+}
+
+var _ Limiter = (*RedisLimiter)(nil)
+
+func (qr *QueueRunner) NewRedisLimiter(name string, rate float64, burst int, perKey bool) *RedisLimiter {
+	if name == "" {
+		panic("empty name")
+	}
+	if rate <= 0 {
+		panic("invalid rate")
+	}
+	if burst <= 0 {
+		panic("invalid burst")
+	}
+	return &RedisLimiter{
+		qr:       qr,
+		name:     name,
+		interval: 1000 / rate,
+		burst:    burst,
+		perKey:   perKey,
+	}
+}
+
+// Take takes up to n tokens of the bucket, with perKey it takes none and returns 1,
+// so the consumer reads one message at a time and Wait takes the token of its key.
+func (l *RedisLimiter) Take(ctx context.Context, n int) (int, error) {
+	if l.perKey {
+		return 1, nil
+	}
+	return l.take(ctx, l.name, n)
+}
+
+// Return puts back up to n tokens taken by Take, with perKey it does nothing
+func (l *RedisLimiter) Return(ctx context.Context, n int) error {
+	if l.perKey || n <= 0 {
+		return nil
+	}
+	_, err := l.qr.evalScript(ctx, scriptLimitReturn, []string{l.name}, l.interval, n)
+	return err
+}
+
+// Wait takes a token of the bucket of the key, without perKey it returns at once
+// as the tokens are taken by Take.
+func (l *RedisLimiter) Wait(ctx context.Context, key string) error {
+	if !l.perKey {
+		return nil
+	}
+	_, err := l.take(ctx, limiterKeyName(l.name, key), 1)
+	return err
+}
+
+func (l *RedisLimiter) take(ctx context.Context, name string, n int) (int, error) {
+	for {
+		result, err := l.qr.evalScript(ctx, scriptLimit, []string{name}, l.interval, l.burst, n)
+		if err != nil {
+			return 0, err
+		}
+		results, _ := result.([]any)
+		if len(results) != 2 {
+			return 0, errors.New("unexpected script result")
+		}
+		if taken := cast.ToInt(results[0]); taken > 0 {
+			return taken, nil
+		}
+		timer := time.NewTimer(time.Duration(cast.ToInt64(results[1])) * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// take returns how many messages may be read, up to n, 0 when the limiter failed.
+// It gives up when the runner starts closing, as nothing is read then.
+func (qr *QueueRunner) take(info *QueueInfo, n int) int {
+	if info.Limiter == nil {
+		return n
+	}
+	taken, err := info.Limiter.Take(qr.closeCtx, n)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) && err != redis.ErrClosed {
+			info.NotifyErr("", "", err)
+		}
+		return 0
+	}
+	return max(min(taken, n), 0)
+}
+
+// giveBack returns the n tokens taken for messages that were not read
+func (qr *QueueRunner) giveBack(info *QueueInfo, n int) {
+	if info.Limiter == nil || n <= 0 {
+		return
+	}
+	if err := info.Limiter.Return(qr.ctx, n); err != nil && err != redis.ErrClosed {
+		info.NotifyErr("", "", err)
+	}
+}
+
+// takeAll takes the tokens of messages already claimed, e.g. the next messages of ordered keys
+func (qr *QueueRunner) takeAll(info *QueueInfo, n int) {
+	for n > 0 {
+		taken := qr.take(info, n)
+		if taken == 0 {
+			return
+		}
+		n -= taken
+	}
+}
+
+// limit waits for the limiter of the queue, a delivery that cannot wait stays pending
+func (qr *QueueRunner) limit(info *QueueInfo, delivery *Delivery) bool {
+	if info.Limiter == nil {
+		return true
+	}
+	if err := qr.waitLimiter(info, delivery); err != nil {
+		if !errors.Is(err, context.Canceled) && err != redis.ErrClosed {
+			info.NotifyErr(delivery.Stream, delivery.Key(), err)
+		}
+		qr.releaseDedupe(info, delivery)
+		return false
+	}
+	return true
+}
+
+// waitLimiter keeps the delivery claimed while Wait blocks, so it does not stay idle
+// long enough for the retry loop to claim and handle it a second time.
+func (qr *QueueRunner) waitLimiter(info *QueueInfo, delivery *Delivery) error {
+	if info.RetryQueueInfo.Stop {
+		return info.Limiter.Wait(qr.ctx, delivery.Key())
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- info.Limiter.Wait(qr.ctx, delivery.Key())
+	}()
+	tick := time.NewTicker(info.RetryQueueInfo.MinIdleTime / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-tick.C:
+			// JUSTID resets the idle time without counting a delivery
+			err := qr.client.XClaimJustID(qr.ctx, &redis.XClaimArgs{
+				Stream:   delivery.Stream,
+				Group:    info.UserQueueInfo.Group,
+				Consumer: delivery.Consumer,
+				Messages: []string{delivery.ID},
+			}).Err()
+			if err != nil && err != redis.ErrClosed {
+				info.NotifyErr(delivery.Stream, delivery.Key(), err)
+			}
+		}
+	}
+}
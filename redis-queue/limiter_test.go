@@ -0,0 +1,169 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLocalLimiterTake(t *testing.T) {
+	l := NewLocalLimiter(20, 5, false)
+	ctx := context.Background()
+
+	// the burst is available at once and caps the tokens taken
+	if n, err := l.Take(ctx, 10); err != nil || n != 5 {
+		t.Fatalf("Take(10) = %d, %v, want 5, nil", n, err)
+	}
+	// then one token per interval
+	start := time.Now()
+	if n, err := l.Take(ctx, 10); err != nil || n != 1 {
+		t.Fatalf("Take(10) = %d, %v, want 1, nil", n, err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("waited %v for a token, want about 50ms", waited)
+	}
+	if err := l.Wait(ctx, "k"); err != nil {
+		t.Errorf("Wait without perKey = %v", err)
+	}
+}
+
+func TestLocalLimiterRefill(t *testing.T) {
+	l := NewLocalLimiter(100, 3, false)
+	ctx := context.Background()
+	if n, _ := l.Take(ctx, 3); n != 3 {
+		t.Fatalf("took %d, want 3", n)
+	}
+	time.Sleep(35 * time.Millisecond)
+	if n, _ := l.Take(ctx, 3); n != 3 {
+		t.Errorf("took %d after the refill, want 3", n)
+	}
+}
+
+func TestLocalLimiterCancel(t *testing.T) {
+	l := NewLocalLimiter(0.1, 1, false)
+	if n, err := l.Take(context.Background(), 1); err != nil || n != 1 {
+		t.Fatalf("Take(1) = %d, %v, want 1, nil", n, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if n, err := l.Take(ctx, 1); !errors.Is(err, context.DeadlineExceeded) || n != 0 {
+		t.Errorf("Take(1) = %d, %v, want 0, %v", n, err, context.DeadlineExceeded)
+	}
+}
+
+func TestLocalLimiterPerKey(t *testing.T) {
+	l := NewLocalLimiter(0.1, 1, true)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if n, err := l.Take(ctx, 10); err != nil || n != 1 {
+			t.Fatalf("Take(10) = %d, %v, want 1, nil", n, err)
+		}
+	}
+	// each key has its own bucket
+	if err := l.Wait(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Wait(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(timeoutCtx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait on an empty bucket = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestLocalLimiterSweep(t *testing.T) {
+	l := NewLocalLimiter(1000, 1, true)
+	ctx := context.Background()
+	for i := 0; i < 1023; i++ {
+		_ = l.Wait(ctx, time.Duration(i).String())
+	}
+	time.Sleep(5 * time.Millisecond)
+	// the 1024th key sweeps the buckets full again
+	_ = l.Wait(ctx, "last")
+	if n := len(l.tats); n != 1 {
+		t.Errorf("%d buckets left, want 1", n)
+	}
+}
+
+func TestLocalLimiterReturn(t *testing.T) {
+	l := NewLocalLimiter(0.1, 5, false)
+	ctx := context.Background()
+	if n, _ := l.Take(ctx, 10); n != 5 {
+		t.Fatalf("took %d, want 5", n)
+	}
+	if err := l.Return(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := l.Take(ctx, 10); n != 3 {
+		t.Errorf("took %d after returning 3, want 3", n)
+	}
+	// more than taken only fills the bucket
+	if err := l.Return(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := l.Take(ctx, 10); n != 5 {
+		t.Errorf("took %d from a full bucket, want 5", n)
+	}
+}
+
+func TestRedisLimiter(t *testing.T) {
+	qr, _ := newRedisRunner(t)
+	l := qr.NewRedisLimiter("l", 0.1, 5, false)
+	ctx := context.Background()
+	if n, err := l.Take(ctx, 10); err != nil || n != 5 {
+		t.Fatalf("Take(10) = %d, %v, want 5, nil", n, err)
+	}
+	if err := l.Return(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := l.Take(ctx, 10); err != nil || n != 2 {
+		t.Fatalf("Take(10) = %d, %v after returning 2, want 2, nil", n, err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Take(timeoutCtx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Take on an empty bucket = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// buckets are shared by name
+	other := qr.NewRedisLimiter("l", 0.1, 5, false)
+	if err := other.Return(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := l.Take(ctx, 10); err != nil || n != 1 {
+		t.Errorf("Take(10) = %d, %v, want 1, nil", n, err)
+	}
+}
+
+func TestTakeInterruptedByShutdown(t *testing.T) {
+	qr := newTestRunner()
+	info := &QueueInfo{Limiter: NewLocalLimiter(0.1, 1, false), NotifyErr: func(stream, key string, err error) {
+		t.Errorf("NotifyErr(%v)", err)
+	}}
+	if n := qr.take(info, 1); n != 1 {
+		t.Fatalf("took %d, want 1", n)
+	}
+	done := make(chan int, 1)
+	go func() {
+		done <- qr.take(info, 1)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := qr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-done:
+		if n != 0 {
+			t.Errorf("took %d while closing, want 0", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("take not interrupted by Shutdown")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Metrics receives the signals of a QueueRunner, implementations must be safe for concurrent use.
+type Metrics interface {
+	Consumed(stream, group string, n int)
+	Handled(stream, group string, duration time.Duration, err error)
+	Acked(stream, group string, n int)
+	Retried(stream, group string, n int)
+	Dead(stream, group string, n int)
+	// Pending and Lag are reported by every runner of the queue, leader or not,
+	// each RetryQueueInfo.Tick or each minute when the retry loop is stopped.
+	Pending(stream, group string, n int64)
+	Lag(stream, group string, n int64)
+}
+
+type NopMetrics struct{}
+
+var _ Metrics = NopMetrics{}
+
+func (NopMetrics) Consumed(stream, group string, n int)                            {}
+func (NopMetrics) Handled(stream, group string, duration time.Duration, err error) {}
+func (NopMetrics) Acked(stream, group string, n int)                               {}
+func (NopMetrics) Retried(stream, group string, n int)                             {}
+func (NopMetrics) Dead(stream, group string, n int)                                {}
+func (NopMetrics) Pending(stream, group string, n int64)                           {}
+func (NopMetrics) Lag(stream, group string, n int64)                               {}
+
+// reportRun reports the gauges of the group until the queue is stopped, paused or not
+func (qr *QueueRunner) reportRun(info *QueueInfo, stop chan struct{}) {
+	interval := info.RetryQueueInfo.Tick
+	if info.RetryQueueInfo.Stop || interval <= 0 {
+		interval = time.Minute
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-qr.closeChan:
+			return
+		case <-stop:
+			return
+		case <-tick.C:
+			for _, stream := range info.UserQueueInfo.streams {
+				qr.reportGroup(qr.ctx, stream, info)
+			}
+		}
+	}
+}
+
+// reportGroup reports the pending count and lag of the group
+func (qr *QueueRunner) reportGroup(ctx context.Context, stream string, info *QueueInfo) {
+	if _, ok := qr.metrics.(NopMetrics); ok {
+		return
+	}
+	xInfoGroups, err := qr.client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		return
+	}
+	for _, xInfoGroup := range xInfoGroups {
+		if xInfoGroup.Name != info.UserQueueInfo.Group {
+			continue
+		}
+		qr.metrics.Pending(stream, xInfoGroup.Name, xInfoGroup.Pending)
+		qr.metrics.Lag(stream, xInfoGroup.Name, xInfoGroup.Lag)
+	}
+}
+
+func countByStream(deliveries []*Delivery) map[string]int {
+	counts := make(map[string]int, 1)
+	for _, delivery := range deliveries {
+		counts[delivery.Stream]++
+	}
+	return counts
+}
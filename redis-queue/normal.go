@@ -5,14 +5,13 @@
 package redisqueue
 
 import (
-	"context"
 	"runtime/debug"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-func (qr *QueueRunner) normalRun(info *QueueInfo) {
+func (qr *QueueRunner) normalRun(info *QueueInfo, consumer string, stop chan struct{}) {
 	defer func() {
 		if r := recover(); r != nil {
 			info.NotifyPanic(r, string(debug.Stack()))
@@ -20,47 +19,56 @@ func (qr *QueueRunner) normalRun(info *QueueInfo) {
 		}
 	}()
 
-	ctx := context.Background()
-	for {
-		xStreams, err := qr.client.XReadGroup(ctx, &redis.XReadGroupArgs{
-			Group:    info.UserQueueInfo.Group,
-			Consumer: info.UserQueueInfo.consumer,
-			Streams:  info.UserQueueInfo.Streams,
-			Count:    info.UserQueueInfo.BatchSize,
-			Block:    0,
-			NoAck:    false,
-		}).Result()
-		if qr.closed {
+	pool := qr.newWorkerPool(info)
+	if pool != nil {
+		defer pool.close()
+	}
+
+	picker := newTierPicker(info.UserQueueInfo.Tiers)
+	for qr.waitActive(info, stop) {
+		if pool != nil && pool.isBroken() {
 			break
 		}
+		// the limiter tokens are taken before reading, so read messages do not wait for them
+		count := int64(qr.take(info, int(info.UserQueueInfo.BatchSize)))
+		if count == 0 {
+			qr.sleep(time.Second)
+			continue
+		}
+		var xStreams []redis.XStream
+		var err error
+		if info.UserQueueInfo.Ordered {
+			xStreams, err = qr.readOrdered(info, consumer, count)
+		} else {
+			xStreams, err = qr.read(info, consumer, picker, count)
+		}
 		if err != nil {
-			if err == redis.ErrClosed {
+			qr.giveBack(info, int(count))
+			if err == redis.Nil { // block timeout
 				continue
 			}
-			if err != redis.Nil {
+			if err != redis.ErrClosed && !qr.closing.Load() {
 				info.NotifyErr("", "", err)
 			}
-			time.Sleep(time.Second)
+			qr.sleep(time.Second)
 			continue
 		}
+		// messages already delivered to this consumer are handled even when closing
+		deliveries := make([]*Delivery, 0, info.UserQueueInfo.BatchSize)
+		now := time.Now()
 		for _, xStream := range xStreams {
-			stream := xStream.Stream
 			for _, xMessage := range xStream.Messages {
-				qr.handleMessage(ctx, info, stream, xMessage)
+				delivery := newDelivery(info, consumer, xStream.Stream, xMessage)
+				delivery.FirstDelivery = now
+				deliveries = append(deliveries, delivery)
 			}
+			qr.metrics.Consumed(xStream.Stream, info.UserQueueInfo.Group, len(xStream.Messages))
 		}
-	}
-}
-
-func (qr *QueueRunner) handleMessage(ctx context.Context, info *QueueInfo, stream string, xMessage redis.XMessage) {
-	key, val := extractValues(xMessage.Values)
-	if err := info.handler(stream, key, val, xMessage.ID); err != nil {
-		info.NotifyErr(stream, key, err)
-		return
-	}
-
-	if _, err := qr.client.XAck(ctx, stream, info.UserQueueInfo.Group, xMessage.ID).Result(); err != nil {
-		info.NotifyErr(stream, key, err)
-		return
+		qr.giveBack(info, int(count)-len(deliveries))
+		if pool == nil {
+			qr.process(info, deliveries)
+			continue
+		}
+		pool.dispatchAll(deliveries)
 	}
 }
@@ -0,0 +1,24 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+type Option func(*QueueRunner)
+
+func WithMetrics(metrics Metrics) Option {
+	return func(qr *QueueRunner) {
+		if metrics == nil {
+			metrics = NopMetrics{}
+		}
+		qr.metrics = metrics
+	}
+}
+
+// WithAutoCreateStream lets Send create the stream when it does not exist,
+// by default sending to a missing stream fails with ErrStreamNotFound.
+func WithAutoCreateStream() Option {
+	return func(qr *QueueRunner) {
+		qr.mkStream = true
+	}
+}
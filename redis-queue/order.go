@@ -0,0 +1,257 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cast"
+)
+
+// Ordered mode handles the messages sharing a key one at a time in ID order, across all consumers.
+// Keyed messages are registered in a per-key zset in the same script that reads them, only the
+// oldest registered message of a key is handled, the others stay pending until the ack of their
+// predecessor claims the next one for the acking consumer. A failed message holds its key until
+// it is acked or dead.
+
+// padStreamID makes IDs sort by their string, zset members share the score 0
+func padStreamID(id string) string {
+	ms, seq, _ := strings.Cut(id, "-")
+	return strings.Repeat("0", max(20-len(ms), 0)) + ms + "-" + strings.Repeat("0", max(20-len(seq), 0)) + seq
+}
+
+func checkOrdered(info *QueueInfo) {
+	if !info.UserQueueInfo.Ordered {
+		return
+	}
+	if len(info.UserQueueInfo.Tiers) > 0 {
+		panic("ordered queue with tiers")
+	}
+	if info.batchHandler != nil {
+		panic("ordered batch consumer")
+	}
+	// a failed message would hold its key forever
+	if info.RetryQueueInfo.Stop {
+		panic("ordered queue without retry")
+	}
+}
+
+// readOrdered reads and registers new messages and returns those first in line for their key, when there are none it waits
+// up to Block for the streams to grow and returns redis.Nil.
+func (qr *QueueRunner) readOrdered(info *QueueInfo, consumer string, count int64) ([]redis.XStream, error) {
+	streams := info.UserQueueInfo.streams
+	args := make([]any, 0, 3+2*len(streams))
+	args = append(args, info.UserQueueInfo.Group, consumer, count)
+	for _, id := range info.UserQueueInfo.Streams[len(streams):] {
+		args = append(args, id)
+	}
+	for _, stream := range streams {
+		args = append(args, orderHashName(stream, info.UserQueueInfo.Group))
+	}
+	result, err := qr.evalScript(qr.ctx, scriptOrderedRead, streams, args...)
+	if err != nil {
+		return nil, err
+	}
+	results, _ := result.([]any)
+	if len(results) != 2 {
+		return nil, errors.New("unexpected script result")
+	}
+	if cast.ToInt64(results[0]) == 1 {
+		return parseXStreams(results[1]), nil
+	}
+
+	// wait for entries after the last ones
+	lastIds := cast.ToStringSlice(results[1])
+	_, err = qr.client.XRead(qr.ctx, &redis.XReadArgs{
+		Streams: append(append(make([]string, 0, 2*len(streams)), streams...), lastIds...),
+		Count:   1,
+		Block:   info.UserQueueInfo.Block,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return nil, redis.Nil
+}
+
+// order returns the deliveries that are the oldest registered message of their key, and those without key
+func (qr *QueueRunner) order(info *QueueInfo, deliveries []*Delivery) []*Delivery {
+	if !info.UserQueueInfo.Ordered || len(deliveries) == 0 {
+		return deliveries
+	}
+	pipe := qr.client.Pipeline()
+	headCmds := make([]*redis.StringSliceCmd, len(deliveries))
+	for i, delivery := range deliveries {
+		if delivery.Key() == "" {
+			continue
+		}
+		headCmds[i] = pipe.ZRange(qr.ctx, orderZSetName(delivery.Stream, info.UserQueueInfo.Group, delivery.Key()), 0, 0)
+	}
+	if pipe.Len() == 0 {
+		return deliveries
+	}
+	if _, err := pipe.Exec(qr.ctx); err != nil && err != redis.Nil {
+		// nothing keyed is handled without knowing its turn, it stays pending
+		if err != redis.ErrClosed {
+			info.NotifyErr(deliveries[0].Stream, "", err)
+		}
+		heads := make([]*Delivery, 0, len(deliveries))
+		for i, delivery := range deliveries {
+			if headCmds[i] == nil {
+				heads = append(heads, delivery)
+			}
+		}
+		return heads
+	}
+	heads := make([]*Delivery, 0, len(deliveries))
+	for i, delivery := range deliveries {
+		if headCmds[i] != nil {
+			// a message that is not registered, e.g. read before the queue became ordered, is not held
+			if head := headCmds[i].Val(); len(head) > 0 && head[0] < padStreamID(delivery.ID) {
+				continue
+			}
+		}
+		heads = append(heads, delivery)
+	}
+	return heads
+}
+
+// leaveOrder unregisters acked deliveries and claims the next message of each key
+// for the same consumer, they are handled by the running process call.
+func (qr *QueueRunner) leaveOrder(info *QueueInfo, deliveries []*Delivery) {
+	if !info.UserQueueInfo.Ordered {
+		return
+	}
+	for _, delivery := range deliveries {
+		if delivery.Key() == "" {
+			continue
+		}
+		keys := []string{
+			orderZSetName(delivery.Stream, info.UserQueueInfo.Group, delivery.Key()),
+			orderHashName(delivery.Stream, info.UserQueueInfo.Group),
+			delivery.Stream,
+		}
+		result, err := qr.evalScript(qr.ctx, scriptOrderLeave, keys, padStreamID(delivery.ID), delivery.ID, info.UserQueueInfo.Group, delivery.Consumer)
+		if err != nil {
+			if err != redis.Nil && err != redis.ErrClosed {
+				info.NotifyErr(delivery.Stream, delivery.Key(), err)
+			}
+			continue
+		}
+		xMessages := parseXMessages([]any{result})
+		if len(xMessages) == 0 {
+			continue
+		}
+		info.control.addPromoted(newDelivery(info, delivery.Consumer, delivery.Stream, xMessages[0]))
+	}
+}
+
+// filterHeads drops the pending ids that wait for an older message of their key
+func (qr *QueueRunner) filterHeads(ctx context.Context, stream string, info *QueueInfo, ids []string) []string {
+	if !info.UserQueueInfo.Ordered || len(ids) == 0 {
+		return ids
+	}
+	keys, err := qr.client.HMGet(ctx, orderHashName(stream, info.UserQueueInfo.Group), ids...).Result()
+	if err != nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		return nil
+	}
+	pipe := qr.client.Pipeline()
+	headCmds := make([]*redis.StringSliceCmd, len(ids))
+	for i, key := range keys {
+		if key == nil {
+			continue
+		}
+		headCmds[i] = pipe.ZRange(ctx, orderZSetName(stream, info.UserQueueInfo.Group, cast.ToString(key)), 0, 0)
+	}
+	if pipe.Len() == 0 {
+		return ids
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		return nil
+	}
+	heads := make([]string, 0, len(ids))
+	for i, id := range ids {
+		if headCmds[i] != nil {
+			if head := headCmds[i].Val(); len(head) > 0 && head[0] != padStreamID(id) {
+				continue
+			}
+		}
+		heads = append(heads, id)
+	}
+	return heads
+}
+
+// leaveDeleted unregisters pending messages whose entries were deleted from the stream
+func (qr *QueueRunner) leaveDeleted(info *QueueInfo, stream string, ids []string) {
+	if !info.UserQueueInfo.Ordered || len(ids) == 0 {
+		return
+	}
+	keys, err := qr.client.HMGet(qr.ctx, orderHashName(stream, info.UserQueueInfo.Group), ids...).Result()
+	if err != nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		return
+	}
+	deliveries := make([]*Delivery, 0, len(ids))
+	for i, key := range keys {
+		if key == nil {
+			continue
+		}
+		deliveries = append(deliveries, &Delivery{
+			Stream:   stream,
+			ID:       ids[i],
+			Group:    info.UserQueueInfo.Group,
+			Consumer: info.RetryQueueInfo.consumer,
+			Values:   map[string]string{keyStr: cast.ToString(key)},
+		})
+	}
+	qr.leaveOrder(info, deliveries)
+}
+
+func parseXStreams(v any) []redis.XStream {
+	items, _ := v.([]any)
+	xStreams := make([]redis.XStream, 0, len(items))
+	for _, item := range items {
+		fields, _ := item.([]any)
+		if len(fields) != 2 {
+			continue
+		}
+		entries, _ := fields[1].([]any)
+		xStreams = append(xStreams, redis.XStream{
+			Stream:   cast.ToString(fields[0]),
+			Messages: parseXMessages(entries),
+		})
+	}
+	return xStreams
+}
+
+func parseXMessages(entries []any) []redis.XMessage {
+	xMessages := make([]redis.XMessage, 0, len(entries))
+	for _, entry := range entries {
+		fields, _ := entry.([]any)
+		if len(fields) != 2 {
+			continue
+		}
+		pairs, _ := fields[1].([]any)
+		values := make(map[string]any, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			values[cast.ToString(pairs[i])] = pairs[i+1]
+		}
+		xMessages = append(xMessages, redis.XMessage{
+			ID:     cast.ToString(fields[0]),
+			Values: values,
+		})
+	}
+	return xMessages
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestPadStreamID(t *testing.T) {
+	if got, want := padStreamID("12-3"), "00000000000000000012-00000000000000000003"; got != want {
+		t.Errorf("padStreamID = %q, want %q", got, want)
+	}
+
+	// padded IDs sort by their string like the IDs do by number
+	ids := []string{"9-0", "10-0", "10-2", "10-10", "1526919030474-0", "0-1"}
+	padded := make([]string, 0, len(ids))
+	for _, id := range ids {
+		padded = append(padded, padStreamID(id))
+	}
+	slices.Sort(padded)
+	want := []string{"0-1", "9-0", "10-0", "10-2", "10-10", "1526919030474-0"}
+	for i, id := range want {
+		if padded[i] != padStreamID(id) {
+			t.Fatalf("sorted padded IDs = %v, want the order of %v", padded, want)
+		}
+	}
+}
+
+func TestCheckOrdered(t *testing.T) {
+	newInfo := func() *QueueInfo {
+		info := &QueueInfo{UserQueueInfo: &UserQueueInfo{Streams: []string{"s", ">"}, Group: "g", Ordered: true}}
+		checkQueueInfo(info)
+		return info
+	}
+	checkOrdered(newInfo())
+
+	tests := map[string]func(info *QueueInfo){
+		"tiers": func(info *QueueInfo) {
+			info.UserQueueInfo.Tiers = []*StreamTier{{Streams: []string{"s", ">"}}}
+		},
+		"batch": func(info *QueueInfo) {
+			info.batchHandler = func(ctx context.Context, deliveries []*Delivery) []error { return nil }
+		},
+		"retry stopped": func(info *QueueInfo) {
+			info.RetryQueueInfo.Stop = true
+		},
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			info := newInfo()
+			modify(info)
+			defer func() {
+				if recover() == nil {
+					t.Error("no panic")
+				}
+			}()
+			checkOrdered(info)
+		})
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sourcegraph/conc"
+	redislock "github.com/sszqdz/bayes-toolkit/redis-lock"
+	"github.com/sszqdz/bayes-toolkit/rrand"
+)
+
+// PartitionInfo makes a queue consume the partitions of a topic, the streams <Topic>:0 to <Topic>:<Partitions-1>,
+// each partition being consumed by one runner at a time. Runners sharing the group heartbeat in redis,
+// the partitions are spread over the live runners by rendezvous hashing, and a runner consumes a partition
+// only while it holds its owner lease. A partition assigned elsewhere is drained before its lease is released,
+// so the next owner starts after the last message of the previous one.
+// Each partition runs as a queue named <Name>:<partition>, which can be paused like any queue,
+// its retry loop runs in its owner whether or not the runner is the leader of WithLeaderElection.
+// Messages sharing a key stay in one partition, they are handled in order with ConsumerSize 1 or with Ordered.
+// Leases are taken with redislock on the client of the runner.
+type PartitionInfo struct {
+	Topic      string
+	Partitions int
+	// MemberTTL is how long a runner stays a member without heartbeat, it is also the TTL of the owner leases
+	MemberTTL time.Duration
+	// Tick is how often runners heartbeat, renew their leases and rebalance, it defaults to MemberTTL/3
+	Tick time.Duration
+	// NotifyAssign is called with the partitions consumed by the runner whenever they change
+	NotifyAssign func(partitions []int)
+}
+
+// WithPartitionedTopic makes sends to topic go to one of its partitions, chosen by the hash of the key,
+// messages without key are spread in turn.
+func WithPartitionedTopic(topic string, partitions int) Option {
+	if topic == "" {
+		panic("empty topic")
+	}
+	if partitions <= 0 {
+		panic("invalid partitions")
+	}
+	return func(qr *QueueRunner) {
+		if qr.topics == nil {
+			qr.topics = make(map[string]int)
+		}
+		qr.topics[topic] = partitions
+	}
+}
+
+// PartitionName returns the stream of the partition
+func PartitionName(topic string, partition int) string {
+	return topic + ":" + strconv.Itoa(partition)
+}
+
+// PartitionOf returns the partition of the key
+func PartitionOf(key string, partitions int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// route returns the partition a message of a topic goes to, other streams are returned as is
+func (qr *QueueRunner) route(stream, key string) string {
+	partitions, ok := qr.topics[stream]
+	if !ok {
+		return stream
+	}
+	if key == "" {
+		return PartitionName(stream, int(qr.topicNext.Add(1)%uint64(partitions)))
+	}
+	return PartitionName(stream, PartitionOf(key, partitions))
+}
+
+// partitionStreams replaces the topics of WithPartitionedTopic with their partitions
+func (qr *QueueRunner) partitionStreams(streams []string) []string {
+	expanded := make([]string, 0, len(streams))
+	for _, stream := range streams {
+		partitions, ok := qr.topics[stream]
+		if !ok {
+			expanded = append(expanded, stream)
+			continue
+		}
+		for partition := 0; partition < partitions; partition++ {
+			expanded = append(expanded, PartitionName(stream, partition))
+		}
+	}
+	return expanded
+}
+
+// checkPartitionInfo fills UserQueueInfo.Streams with the partitions
+func checkPartitionInfo(info *QueueInfo) {
+	partitionInfo := info.PartitionInfo
+	if partitionInfo == nil {
+		return
+	}
+	userQueueInfo := info.UserQueueInfo
+	if partitionInfo.Topic == "" {
+		panic("empty topic")
+	}
+	if partitionInfo.Partitions <= 0 {
+		panic("invalid partitions")
+	}
+	if len(userQueueInfo.Tiers) > 0 {
+		panic("partitioned queue with tiers")
+	}
+	if len(userQueueInfo.Streams) > 0 && !userQueueInfo.partitioned {
+		panic("both streams and partitions")
+	}
+	if partitionInfo.MemberTTL < 0 {
+		panic("invalid member ttl")
+	}
+	if partitionInfo.MemberTTL == 0 {
+		partitionInfo.MemberTTL = 10 * time.Second
+	}
+	if partitionInfo.Tick < 0 || partitionInfo.Tick >= partitionInfo.MemberTTL {
+		panic("invalid partition tick")
+	}
+	if partitionInfo.Tick == 0 {
+		partitionInfo.Tick = partitionInfo.MemberTTL / 3
+	}
+	if partitionInfo.NotifyAssign == nil {
+		partitionInfo.NotifyAssign = func(partitions []int) {}
+	}
+	streams := make([]string, 0, 2*partitionInfo.Partitions)
+	for partition := 0; partition < partitionInfo.Partitions; partition++ {
+		streams = append(streams, PartitionName(partitionInfo.Topic, partition))
+	}
+	for partition := 0; partition < partitionInfo.Partitions; partition++ {
+		streams = append(streams, ">")
+	}
+	userQueueInfo.Streams = streams
+	userQueueInfo.partitioned = true
+}
+
+// partitionQueueInfo derives the queue consuming one partition from the partitioned queue
+func partitionQueueInfo(info *QueueInfo, partition int) *QueueInfo {
+	userQueueInfo := *info.UserQueueInfo
+	userQueueInfo.Streams = []string{PartitionName(info.PartitionInfo.Topic, partition), ">"}
+	userQueueInfo.partitioned = false
+	retryQueueInfo := *info.RetryQueueInfo
+	deadQueueInfo := *info.DeadQueueInfo
+
+	queueInfo := *info
+	queueInfo.Name = info.Name + ":" + strconv.Itoa(partition)
+	queueInfo.UserQueueInfo = &userQueueInfo
+	queueInfo.RetryQueueInfo = &retryQueueInfo
+	queueInfo.DeadQueueInfo = &deadQueueInfo
+	queueInfo.PartitionInfo = nil
+	queueInfo.control = nil
+	queueInfo.exclusive = true
+	return &queueInfo
+}
+
+// partitionedQueue is only touched by its rebalance loop
+type partitionedQueue struct {
+	info   *QueueInfo
+	member string
+	owned  map[int]*ownedPartition
+}
+
+type ownedPartition struct {
+	info    *QueueInfo
+	renewed time.Time
+	drained chan struct{} // nil while running, closed once revoked and drained
+	lost    bool          // the lease expired and may be held by another runner
+}
+
+// runPartitioned starts the loop running the partitions assigned to the runner
+func (qr *QueueRunner) runPartitioned(info *QueueInfo) error {
+	p := &partitionedQueue{
+		info:   info,
+		member: info.UserQueueInfo.consumer + "-" + rrand.RandStr(8),
+		owned:  make(map[int]*ownedPartition),
+	}
+	return qr.spawn(func(wg *conc.WaitGroup) {
+		wg.Go(func() {
+			tick := time.NewTicker(info.PartitionInfo.Tick)
+			defer tick.Stop()
+			for {
+				qr.rebalance(p)
+				select {
+				case <-qr.closeChan:
+					qr.leavePartitions(p)
+					return
+				case <-tick.C:
+				}
+			}
+		})
+	})
+}
+
+// rebalance renews the leases, revokes the partitions assigned elsewhere and starts the new ones
+func (qr *QueueRunner) rebalance(p *partitionedQueue) {
+	info := p.info
+	partitionInfo := info.PartitionInfo
+	changed := false
+	for partition, owned := range p.owned {
+		if owned.drained != nil {
+			select {
+			case <-owned.drained:
+				if !owned.lost {
+					qr.releasePartition(p, partition)
+				}
+				delete(p.owned, partition)
+				continue
+			default:
+			}
+		}
+		if owned.lost {
+			continue
+		}
+		ok, err := redislock.TryLeaseWith(qr.ctx, qr.client, partitionOwnerName(owned.info.UserQueueInfo.streams[0], info.UserQueueInfo.Group), p.member, partitionInfo.MemberTTL)
+		if err != nil {
+			if err != redis.ErrClosed {
+				info.NotifyErr(owned.info.UserQueueInfo.streams[0], "", err)
+			}
+			// the lease may still be ours until it expires
+			if time.Since(owned.renewed) < partitionInfo.MemberTTL {
+				continue
+			}
+		}
+		if ok {
+			owned.renewed = time.Now()
+			continue
+		}
+		owned.lost = true
+		if owned.drained == nil {
+			qr.revokePartition(owned)
+			changed = true
+		}
+	}
+
+	members, err := qr.heartbeat(p)
+	if err != nil {
+		// the assignment is kept until the members are known
+		if err != redis.ErrClosed {
+			info.NotifyErr(partitionInfo.Topic, "", err)
+		}
+	} else {
+		assigned := assignPartitions(members, partitionInfo.Partitions, p.member)
+		for partition, owned := range p.owned {
+			if _, ok := assigned[partition]; !ok && owned.drained == nil {
+				qr.revokePartition(owned)
+				changed = true
+			}
+		}
+		for partition := range assigned {
+			if _, ok := p.owned[partition]; ok {
+				continue
+			}
+			if qr.acquirePartition(p, partition) {
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		running := make([]int, 0, len(p.owned))
+		for partition, owned := range p.owned {
+			if owned.drained == nil {
+				running = append(running, partition)
+			}
+		}
+		slices.Sort(running)
+		partitionInfo.NotifyAssign(running)
+	}
+}
+
+// heartbeat refreshes the membership of the runner and returns the live members
+func (qr *QueueRunner) heartbeat(p *partitionedQueue) ([]string, error) {
+	partitionInfo := p.info.PartitionInfo
+	key := partitionMembersName(partitionInfo.Topic, p.info.UserQueueInfo.Group)
+	now := time.Now()
+	pipe := qr.client.Pipeline()
+	pipe.ZAdd(qr.ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: p.member})
+	pipe.ZRemRangeByScore(qr.ctx, key, "-inf", "("+strconv.FormatInt(now.Add(-partitionInfo.MemberTTL).UnixMilli(), 10))
+	membersCmd := pipe.ZRange(qr.ctx, key, 0, -1)
+	pipe.PExpire(qr.ctx, key, partitionInfo.MemberTTL)
+	if _, err := pipe.Exec(qr.ctx); err != nil {
+		return nil, err
+	}
+	return membersCmd.Val(), nil
+}
+
+// acquirePartition runs the partition once its lease is free, e.g. released by the previous owner
+func (qr *QueueRunner) acquirePartition(p *partitionedQueue, partition int) bool {
+	info := p.info
+	partInfo := partitionQueueInfo(info, partition)
+	stream := PartitionName(info.PartitionInfo.Topic, partition)
+	ok, err := redislock.TryLeaseWith(qr.ctx, qr.client, partitionOwnerName(stream, info.UserQueueInfo.Group), p.member, info.PartitionInfo.MemberTTL)
+	if err != nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		return false
+	}
+	if !ok {
+		return false
+	}
+	renewed := time.Now()
+	if err := qr.run(partInfo, info.handler, info.batchHandler); err != nil {
+		if err != ErrRunnerClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		qr.releasePartition(p, partition)
+		return false
+	}
+	p.owned[partition] = &ownedPartition{info: partInfo, renewed: renewed}
+	return true
+}
+
+// revokePartition drains the partition in the background, its lease is kept meanwhile
+func (qr *QueueRunner) revokePartition(owned *ownedPartition) {
+	drained := make(chan struct{})
+	owned.drained = drained
+	go func() {
+		defer close(drained)
+		if err := qr.Remove(qr.ctx, owned.info.Name); err != nil && err != ErrQueueNotFound {
+			owned.info.NotifyErr(owned.info.UserQueueInfo.streams[0], "", err)
+		}
+	}()
+}
+
+func (qr *QueueRunner) releasePartition(p *partitionedQueue, partition int) {
+	stream := PartitionName(p.info.PartitionInfo.Topic, partition)
+	if _, err := redislock.ReleaseLeaseWith(qr.ctx, qr.client, partitionOwnerName(stream, p.info.UserQueueInfo.Group), p.member); err != nil {
+		if err != redis.ErrClosed {
+			p.info.NotifyErr(stream, "", err)
+		}
+	}
+}
+
+// leavePartitions waits for the partitions stopped by the closing runner, then gives them up
+func (qr *QueueRunner) leavePartitions(p *partitionedQueue) {
+	for partition, owned := range p.owned {
+		if owned.drained != nil {
+			select {
+			case <-owned.drained:
+			case <-qr.ctx.Done():
+			}
+		} else {
+			_ = qr.waitQueue(qr.ctx, owned.info)
+		}
+		if !owned.lost {
+			qr.releasePartition(p, partition)
+		}
+		delete(p.owned, partition)
+	}
+	key := partitionMembersName(p.info.PartitionInfo.Topic, p.info.UserQueueInfo.Group)
+	if _, err := qr.client.ZRem(qr.ctx, key, p.member).Result(); err != nil && err != redis.ErrClosed {
+		p.info.NotifyErr(p.info.PartitionInfo.Topic, "", err)
+	}
+	p.info.PartitionInfo.NotifyAssign(nil)
+}
+
+// assignPartitions returns the partitions of member, each partition goes to the member with the
+// highest hash of both, so a member joining or leaving only moves its own share.
+func assignPartitions(members []string, partitions int, member string) map[int]struct{} {
+	assigned := make(map[int]struct{})
+	for partition := 0; partition < partitions; partition++ {
+		var best string
+		var bestScore uint64
+		for _, m := range members {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(m + ":" + strconv.Itoa(partition)))
+			score := mix64(h.Sum64())
+			if best == "" || score > bestScore || (score == bestScore && m < best) {
+				best, bestScore = m, score
+			}
+		}
+		if best == member {
+			assigned[partition] = struct{}{}
+		}
+	}
+	return assigned
+}
+
+// mix64 spreads the bits of FNV, whose last bytes barely reach the high bits
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestAssignPartitions(t *testing.T) {
+	const partitions = 64
+	members := []string{"a", "b", "c", "d"}
+
+	owners := make(map[int]string)
+	for _, member := range members {
+		assigned := assignPartitions(members, partitions, member)
+		if len(assigned) == 0 {
+			t.Errorf("member %s got no partition", member)
+		}
+		for partition := range assigned {
+			if owner, ok := owners[partition]; ok {
+				t.Fatalf("partition %d assigned to %s and %s", partition, owner, member)
+			}
+			owners[partition] = member
+		}
+	}
+	if len(owners) != partitions {
+		t.Fatalf("%d of %d partitions assigned", len(owners), partitions)
+	}
+
+	// the order of the members does not matter
+	reversed := []string{"d", "c", "b", "a"}
+	for _, member := range members {
+		for partition := range assignPartitions(reversed, partitions, member) {
+			if owners[partition] != member {
+				t.Errorf("partition %d moved from %s to %s with reversed members", partition, owners[partition], member)
+			}
+		}
+	}
+
+	// a leaving member only moves its own partitions
+	left := members[:3]
+	for _, member := range left {
+		for partition := range assignPartitions(left, partitions, member) {
+			if owner := owners[partition]; owner != member && owner != "d" {
+				t.Errorf("partition %d moved from %s to %s", partition, owner, member)
+			}
+		}
+	}
+}
+
+func TestAssignPartitionsSpread(t *testing.T) {
+	const partitions = 1000
+	members := make([]string, 10)
+	for i := range members {
+		members[i] = fmt.Sprintf("host-%d", i)
+	}
+	for _, member := range members {
+		// the even share is 100
+		if n := len(assignPartitions(members, partitions, member)); n < 50 || n > 150 {
+			t.Errorf("member %s got %d partitions", member, n)
+		}
+	}
+}
+
+func TestAssignPartitionsNotMember(t *testing.T) {
+	if assigned := assignPartitions([]string{"a", "b"}, 8, "c"); len(assigned) != 0 {
+		t.Errorf("non member got %v", assigned)
+	}
+	if assigned := assignPartitions(nil, 8, "a"); len(assigned) != 0 {
+		t.Errorf("no members got %v", assigned)
+	}
+}
+
+func TestRunDelayPartitionedTopic(t *testing.T) {
+	qr := NewQueueRunner(redis.NewClient(&redis.Options{Addr: "127.0.0.1:0", MaxRetries: -1}), WithPartitionedTopic("t", 3))
+	defer qr.Close()
+	delayInfo := &DelayInfo{Streams: []string{"t", "s"}, Tick: time.Hour}
+	if err := qr.RunDelay(delayInfo); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"t:0", "t:1", "t:2", "s"}; !slices.Equal(delayInfo.Streams, want) {
+		t.Errorf("streams %v, want %v", delayInfo.Streams, want)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/sszqdz/bayes-toolkit/rrand"
+)
+
+// RetryPolicy decides when a failed message is redelivered,
+// attempt is the number of times the message has been delivered so far.
+type RetryPolicy interface {
+	NextDelay(attempt int64, err error) time.Duration
+}
+
+type RetryPolicyFunc func(attempt int64, err error) time.Duration
+
+func (f RetryPolicyFunc) NextDelay(attempt int64, err error) time.Duration {
+	return f(attempt, err)
+}
+
+type FixedRetry struct {
+	Delay time.Duration
+}
+
+func (r FixedRetry) NextDelay(attempt int64, err error) time.Duration {
+	return r.Delay
+}
+
+// maxExponentialDelay bounds an ExponentialRetry without Max, the doubling would overflow
+const maxExponentialDelay = time.Duration(math.MaxInt64 / 2)
+
+// ExponentialRetry doubles Base on every attempt up to Max, then adds a random jitter below Jitter
+type ExponentialRetry struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter time.Duration
+}
+
+func (r ExponentialRetry) NextDelay(attempt int64, err error) time.Duration {
+	limit := r.Max
+	if limit <= 0 {
+		limit = maxExponentialDelay
+	}
+	delay := r.Base
+	for i := int64(1); i < attempt && delay > 0 && delay < limit; i++ {
+		if delay > limit/2 {
+			delay = limit
+			break
+		}
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	if r.Jitter >= time.Millisecond {
+		delay += rrand.RandDuration(int64(r.Jitter/time.Millisecond), time.Millisecond)
+	}
+	return delay
+}
+
+// RetryOn uses policy for errors matching target and fallback for the others
+func RetryOn(target error, policy, fallback RetryPolicy) RetryPolicy {
+	return RetryPolicyFunc(func(attempt int64, err error) time.Duration {
+		if errors.Is(err, target) {
+			return policy.NextDelay(attempt, err)
+		}
+		return fallback.NextDelay(attempt, err)
+	})
+}
+
+// RetryOnType uses policy for errors of type E and fallback for the others
+func RetryOnType[E error](policy, fallback RetryPolicy) RetryPolicy {
+	return RetryPolicyFunc(func(attempt int64, err error) time.Duration {
+		var target E
+		if errors.As(err, &target) {
+			return policy.NextDelay(attempt, err)
+		}
+		return fallback.NextDelay(attempt, err)
+	})
+}
+
+type RetryAfterError struct {
+	Delay time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return "retry after " + e.Delay.String()
+}
+
+// RetryAfter is returned by handlers to redeliver the message after d regardless of the policy
+func RetryAfter(d time.Duration) error {
+	return &RetryAfterError{Delay: d}
+}
+
+// nextDelay returns false when the message is left to the MinIdleTime based retry
+func (info *RetryQueueInfo) nextDelay(attempt int64, err error) (time.Duration, bool) {
+	var retryAfter *RetryAfterError
+	if errors.As(err, &retryAfter) {
+		return retryAfter.Delay, true
+	}
+	if info.Policy == nil {
+		return 0, false
+	}
+	return info.Policy.NextDelay(attempt, err), true
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExponentialRetry(t *testing.T) {
+	r := ExponentialRetry{Base: time.Second, Max: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, d := range want {
+		if got := r.NextDelay(int64(i+1), nil); got != d {
+			t.Errorf("attempt %d: delay %v, want %v", i+1, got, d)
+		}
+	}
+	if got := r.NextDelay(1000000, nil); got != r.Max {
+		t.Errorf("large attempt: delay %v, want %v", got, r.Max)
+	}
+}
+
+func TestExponentialRetryWithoutMax(t *testing.T) {
+	r := ExponentialRetry{Base: time.Second}
+	if got := r.NextDelay(3, nil); got != 4*time.Second {
+		t.Errorf("attempt 3: delay %v, want %v", got, 4*time.Second)
+	}
+	prev := time.Duration(0)
+	for attempt := int64(1); attempt <= 200; attempt++ {
+		got := r.NextDelay(attempt, nil)
+		if got < prev {
+			t.Fatalf("attempt %d: delay %v below the previous %v", attempt, got, prev)
+		}
+		prev = got
+	}
+	if prev != maxExponentialDelay {
+		t.Errorf("delay %v, want the bound %v", prev, maxExponentialDelay)
+	}
+}
+
+func TestExponentialRetryJitter(t *testing.T) {
+	r := ExponentialRetry{Base: time.Second, Max: time.Minute, Jitter: 100 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		if got := r.NextDelay(2, nil); got < 2*time.Second || got >= 2*time.Second+r.Jitter {
+			t.Fatalf("delay %v out of [2s, 2.1s)", got)
+		}
+	}
+}
+
+func TestRetryOn(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	policy := RetryOn(errTimeout, FixedRetry{Delay: time.Second}, FixedRetry{Delay: time.Minute})
+	if got := policy.NextDelay(1, Dead(errTimeout)); got != time.Second {
+		t.Errorf("wrapped target: delay %v, want %v", got, time.Second)
+	}
+	if got := policy.NextDelay(1, errors.New("other")); got != time.Minute {
+		t.Errorf("other error: delay %v, want %v", got, time.Minute)
+	}
+}
+
+func TestNextDelay(t *testing.T) {
+	info := &RetryQueueInfo{}
+	if _, ok := info.nextDelay(1, errors.New("failed")); ok {
+		t.Error("delay without policy")
+	}
+	if d, ok := info.nextDelay(1, RetryAfter(time.Hour)); !ok || d != time.Hour {
+		t.Errorf("RetryAfter: delay %v, %v, want %v, true", d, ok, time.Hour)
+	}
+	info.Policy = FixedRetry{Delay: time.Second}
+	if d, ok := info.nextDelay(1, errors.New("failed")); !ok || d != time.Second {
+		t.Errorf("policy: delay %v, %v, want %v, true", d, ok, time.Second)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sourcegraph/conc"
+)
+
+// workerPool handles the messages read by one consumer concurrently,
+// messages sharing a key always go to the same worker so their order is kept.
+// Messages waiting for their worker are kept claimed so the retry loop does not take them.
+type workerPool struct {
+	chans     []chan *Delivery
+	wg        *conc.WaitGroup
+	broken    chan struct{} // closed when a worker panics
+	breakOnce sync.Once
+	next      int
+	stop      chan struct{}
+
+	waitingMu sync.Mutex
+	waiting   map[*Delivery]struct{} // read but not taken by a worker yet
+}
+
+func (qr *QueueRunner) newWorkerPool(info *QueueInfo) *workerPool {
+	if info.UserQueueInfo.WorkerSize <= 1 {
+		return nil
+	}
+	pool := &workerPool{
+		chans:   make([]chan *Delivery, 0, info.UserQueueInfo.WorkerSize),
+		wg:      conc.NewWaitGroup(),
+		broken:  make(chan struct{}),
+		stop:    make(chan struct{}),
+		waiting: make(map[*Delivery]struct{}),
+	}
+	for i := 0; i < info.UserQueueInfo.WorkerSize; i++ {
+		ch := make(chan *Delivery, info.UserQueueInfo.WorkerBuffer)
+		pool.chans = append(pool.chans, ch)
+		pool.wg.Go(func() {
+			defer func() {
+				if r := recover(); r != nil {
+					pool.breakOnce.Do(func() { close(pool.broken) })
+					panic(r)
+				}
+			}()
+			for delivery := range ch {
+				pool.take(delivery)
+				qr.process(info, []*Delivery{delivery})
+			}
+		})
+	}
+	if !info.RetryQueueInfo.Stop {
+		pool.wg.Go(func() { qr.keepClaimed(info, pool) })
+	}
+
+	return pool
+}
+
+// keepClaimed resets the idle time of the waiting messages every MinIdleTime/2,
+// so they are not claimed and handled a second time by the retry loop.
+func (qr *QueueRunner) keepClaimed(info *QueueInfo, pool *workerPool) {
+	tick := time.NewTicker(info.RetryQueueInfo.MinIdleTime / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-pool.stop:
+			return
+		case <-tick.C:
+		}
+		waiting := pool.waitingIds()
+		if len(waiting) == 0 {
+			continue
+		}
+		pipe := qr.client.Pipeline()
+		for stream, ids := range waiting {
+			// JUSTID resets the idle time without counting a delivery
+			pipe.XClaimJustID(qr.ctx, &redis.XClaimArgs{
+				Stream:   stream,
+				Group:    info.UserQueueInfo.Group,
+				Consumer: ids[0].Consumer,
+				Messages: deliveryIds(ids),
+			})
+		}
+		if _, err := pipe.Exec(qr.ctx); err != nil && err != redis.ErrClosed {
+			info.NotifyErr("", "", err)
+		}
+	}
+}
+
+// dispatchAll hands the deliveries to their workers, it returns false when a worker has panicked
+func (pool *workerPool) dispatchAll(deliveries []*Delivery) bool {
+	pool.waitingMu.Lock()
+	for _, delivery := range deliveries {
+		pool.waiting[delivery] = struct{}{}
+	}
+	pool.waitingMu.Unlock()
+	for _, delivery := range deliveries {
+		if !pool.dispatch(delivery) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pool *workerPool) take(delivery *Delivery) {
+	pool.waitingMu.Lock()
+	delete(pool.waiting, delivery)
+	pool.waitingMu.Unlock()
+}
+
+// waitingIds groups the waiting deliveries by stream
+func (pool *workerPool) waitingIds() map[string][]*Delivery {
+	pool.waitingMu.Lock()
+	defer pool.waitingMu.Unlock()
+	waiting := make(map[string][]*Delivery, 1)
+	for delivery := range pool.waiting {
+		waiting[delivery.Stream] = append(waiting[delivery.Stream], delivery)
+	}
+	return waiting
+}
+
+// dispatch blocks while the worker is busy and its buffer is full,
+// it returns false when a worker has panicked.
+func (pool *workerPool) dispatch(delivery *Delivery) bool {
+	var idx int
+	if key := delivery.Key(); key != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		idx = int(h.Sum32() % uint32(len(pool.chans)))
+	} else {
+		idx = pool.next
+		pool.next = (pool.next + 1) % len(pool.chans)
+	}
+	select {
+	case pool.chans[idx] <- delivery:
+		return true
+	case <-pool.broken:
+		return false
+	}
+}
+
+func (pool *workerPool) isBroken() bool {
+	select {
+	case <-pool.broken:
+		return true
+	default:
+		return false
+	}
+}
+
+// close waits for the in-flight messages, and panics again if a worker has panicked
+func (pool *workerPool) close() {
+	for _, ch := range pool.chans {
+		close(ch)
+	}
+	close(pool.stop)
+	pool.wg.Wait()
+}
+
+func deliveryIds(deliveries []*Delivery) []string {
+	ids := make([]string, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		ids = append(ids, delivery.ID)
+	}
+	return ids
+}
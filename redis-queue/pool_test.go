@@ -0,0 +1,74 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolKeepsBufferedClaimed(t *testing.T) {
+	qr, _ := newRedisRunner(t, WithAutoCreateStream())
+	var mu sync.Mutex
+	handled := make(map[string]int)
+	done := make(chan struct{}, 8)
+	consumer := &testConsumer{
+		info: &QueueInfo{
+			UserQueueInfo: &UserQueueInfo{
+				Streams:       []string{"s", ">"},
+				NewGroupStart: "0",
+				Group:         "g",
+				BatchSize:     8,
+				WorkerSize:    2,
+				WorkerBuffer:  8,
+				Block:         50 * time.Millisecond,
+			},
+			RetryQueueInfo: &RetryQueueInfo{
+				Tick:        20 * time.Millisecond,
+				MinIdleTime: 100 * time.Millisecond,
+				MinRetry:    100,
+			},
+		},
+		// messages sharing a key wait in the buffer of one worker
+		consume: func(ctx context.Context, delivery *Delivery) error {
+			time.Sleep(30 * time.Millisecond)
+			mu.Lock()
+			handled[delivery.ID]++
+			mu.Unlock()
+			done <- struct{}{}
+			return nil
+		},
+	}
+	ctx := context.Background()
+	for i := 0; i < 8; i++ {
+		if _, err := qr.SendWithKey(ctx, "s", "k", "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := qr.RunConsumer(consumer); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handled %d messages", i)
+		}
+	}
+	// leave time for a wrong retry
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != 8 {
+		t.Errorf("handled %d messages, want 8", len(handled))
+	}
+	for id, n := range handled {
+		if n != 1 {
+			t.Errorf("%s handled %d times", id, n)
+		}
+	}
+}
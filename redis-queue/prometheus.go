@@ -0,0 +1,215 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"bufio"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type labels struct {
+	stream string
+	group  string
+}
+
+func (l labels) String() string {
+	return `stream="` + escapeLabel(l.stream) + `",group="` + escapeLabel(l.group) + `"`
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// PrometheusMetrics keeps the metrics in memory and serves them
+// in the Prometheus text exposition format as an http.Handler.
+type PrometheusMetrics struct {
+	namespace string
+	buckets   []float64
+
+	mutex      sync.Mutex
+	consumed   map[labels]uint64
+	handleErrs map[labels]uint64
+	acked      map[labels]uint64
+	retried    map[labels]uint64
+	dead       map[labels]uint64
+	pending    map[labels]int64
+	lag        map[labels]int64
+	durations  map[labels]*histogram
+}
+
+var (
+	_ Metrics      = (*PrometheusMetrics)(nil)
+	_ http.Handler = (*PrometheusMetrics)(nil)
+)
+
+// NewPrometheusMetrics uses "redisqueue" when namespace is empty and DefaultBuckets when buckets is empty
+func NewPrometheusMetrics(namespace string, buckets ...float64) *PrometheusMetrics {
+	if namespace == "" {
+		namespace = "redisqueue"
+	}
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &PrometheusMetrics{
+		namespace:  namespace,
+		buckets:    buckets,
+		consumed:   make(map[labels]uint64),
+		handleErrs: make(map[labels]uint64),
+		acked:      make(map[labels]uint64),
+		retried:    make(map[labels]uint64),
+		dead:       make(map[labels]uint64),
+		pending:    make(map[labels]int64),
+		lag:        make(map[labels]int64),
+		durations:  make(map[labels]*histogram),
+	}
+}
+
+func (m *PrometheusMetrics) Consumed(stream, group string, n int) {
+	m.mutex.Lock()
+	m.consumed[labels{stream, group}] += uint64(n)
+	m.mutex.Unlock()
+}
+
+func (m *PrometheusMetrics) Handled(stream, group string, duration time.Duration, err error) {
+	l := labels{stream, group}
+	seconds := duration.Seconds()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := m.durations[l]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.durations[l] = h
+	}
+	if i, _ := slices.BinarySearch(m.buckets, seconds); i < len(m.buckets) {
+		h.counts[i]++
+	}
+	h.sum += seconds
+	h.count++
+	if err != nil {
+		m.handleErrs[l]++
+	}
+}
+
+func (m *PrometheusMetrics) Acked(stream, group string, n int) {
+	m.mutex.Lock()
+	m.acked[labels{stream, group}] += uint64(n)
+	m.mutex.Unlock()
+}
+
+func (m *PrometheusMetrics) Retried(stream, group string, n int) {
+	m.mutex.Lock()
+	m.retried[labels{stream, group}] += uint64(n)
+	m.mutex.Unlock()
+}
+
+func (m *PrometheusMetrics) Dead(stream, group string, n int) {
+	m.mutex.Lock()
+	m.dead[labels{stream, group}] += uint64(n)
+	m.mutex.Unlock()
+}
+
+func (m *PrometheusMetrics) Pending(stream, group string, n int64) {
+	m.mutex.Lock()
+	m.pending[labels{stream, group}] = n
+	m.mutex.Unlock()
+}
+
+func (m *PrometheusMetrics) Lag(stream, group string, n int64) {
+	m.mutex.Lock()
+	m.lag[labels{stream, group}] = n
+	m.mutex.Unlock()
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	m.write(bw)
+	_ = bw.Flush()
+}
+
+func (m *PrometheusMetrics) write(w *bufio.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	writeCounter(w, m.namespace+"_messages_consumed_total", "Messages read from streams.", m.consumed)
+	writeCounter(w, m.namespace+"_handle_errors_total", "Handler errors.", m.handleErrs)
+	writeCounter(w, m.namespace+"_messages_acked_total", "Messages acked.", m.acked)
+	writeCounter(w, m.namespace+"_messages_retried_total", "Messages redelivered by the retry loop.", m.retried)
+	writeCounter(w, m.namespace+"_messages_dead_total", "Messages sent to the dead store.", m.dead)
+	writeGauge(w, m.namespace+"_pending_messages", "Messages delivered but not acked.", m.pending)
+	writeGauge(w, m.namespace+"_consumer_lag", "Messages not yet delivered to the group.", m.lag)
+
+	name := m.namespace + "_handle_duration_seconds"
+	writeHeader(w, name, "Handler latency.", "histogram")
+	for _, l := range sortedLabels(m.durations) {
+		h := m.durations[l]
+		var cumulative uint64
+		for i, bucket := range m.buckets {
+			cumulative += h.counts[i]
+			writeSample(w, name+"_bucket", l.String()+`,le="`+formatFloat(bucket)+`"`, strconv.FormatUint(cumulative, 10))
+		}
+		writeSample(w, name+"_bucket", l.String()+`,le="+Inf"`, strconv.FormatUint(h.count, 10))
+		writeSample(w, name+"_sum", l.String(), formatFloat(h.sum))
+		writeSample(w, name+"_count", l.String(), strconv.FormatUint(h.count, 10))
+	}
+}
+
+func writeCounter(w *bufio.Writer, name, help string, values map[labels]uint64) {
+	writeHeader(w, name, help, "counter")
+	for _, l := range sortedLabels(values) {
+		writeSample(w, name, l.String(), strconv.FormatUint(values[l], 10))
+	}
+}
+
+func writeGauge(w *bufio.Writer, name, help string, values map[labels]int64) {
+	writeHeader(w, name, help, "gauge")
+	for _, l := range sortedLabels(values) {
+		writeSample(w, name, l.String(), strconv.FormatInt(values[l], 10))
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	_, _ = w.WriteString("# HELP " + name + " " + help + "\n")
+	_, _ = w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeSample(w *bufio.Writer, name, labelStr, value string) {
+	_, _ = w.WriteString(name + "{" + labelStr + "} " + value + "\n")
+}
+
+func sortedLabels[V any](values map[labels]V) []labels {
+	keys := make([]labels, 0, len(values))
+	for l := range values {
+		keys = append(keys, l)
+	}
+	slices.SortFunc(keys, func(a, b labels) int {
+		if c := strings.Compare(a.stream, b.stream); c != 0 {
+			return c
+		}
+		return strings.Compare(a.group, b.group)
+	})
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics("q", 1, 0.1)
+	m.Consumed("s", "g", 3)
+	m.Consumed("s", "g", 2)
+	m.Consumed(`a"b`, "g\n", 1)
+	m.Handled("s", "g", 50*time.Millisecond, nil)
+	m.Handled("s", "g", 100*time.Millisecond, nil)
+	m.Handled("s", "g", 2*time.Second, errors.New("failed"))
+	m.Acked("s", "g", 2)
+	m.Pending("s", "g", 4)
+	m.Pending("s", "g", 1)
+	m.Lag("s", "g", 0)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content type %q", got)
+	}
+	want := `# HELP q_messages_consumed_total Messages read from streams.
+# TYPE q_messages_consumed_total counter
+q_messages_consumed_total{stream="a\"b",group="g\n"} 1
+q_messages_consumed_total{stream="s",group="g"} 5
+# HELP q_handle_errors_total Handler errors.
+# TYPE q_handle_errors_total counter
+q_handle_errors_total{stream="s",group="g"} 1
+# HELP q_messages_acked_total Messages acked.
+# TYPE q_messages_acked_total counter
+q_messages_acked_total{stream="s",group="g"} 2
+# HELP q_messages_retried_total Messages redelivered by the retry loop.
+# TYPE q_messages_retried_total counter
+# HELP q_messages_dead_total Messages sent to the dead store.
+# TYPE q_messages_dead_total counter
+# HELP q_pending_messages Messages delivered but not acked.
+# TYPE q_pending_messages gauge
+q_pending_messages{stream="s",group="g"} 1
+# HELP q_consumer_lag Messages not yet delivered to the group.
+# TYPE q_consumer_lag gauge
+q_consumer_lag{stream="s",group="g"} 0
+# HELP q_handle_duration_seconds Handler latency.
+# TYPE q_handle_duration_seconds histogram
+q_handle_duration_seconds_bucket{stream="s",group="g",le="0.1"} 2
+q_handle_duration_seconds_bucket{stream="s",group="g",le="1"} 2
+q_handle_duration_seconds_bucket{stream="s",group="g",le="+Inf"} 3
+q_handle_duration_seconds_sum{stream="s",group="g"} 2.15
+q_handle_duration_seconds_count{stream="s",group="g"} 3
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("metrics:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPrometheusMetricsDefaults(t *testing.T) {
+	m := NewPrometheusMetrics("")
+	if m.namespace != "redisqueue" {
+		t.Errorf("namespace %q, want redisqueue", m.namespace)
+	}
+	if len(m.buckets) != len(DefaultBuckets) {
+		t.Errorf("%d buckets, want %d", len(m.buckets), len(DefaultBuckets))
+	}
+}
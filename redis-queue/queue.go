@@ -6,6 +6,11 @@ package redisqueue
 
 import (
 	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/adrianbrad/queue"
 	"github.com/redis/go-redis/v9"
@@ -18,22 +23,59 @@ type IQueue interface {
 	Handle(stream, key, val, msgId string) error
 }
 
+var ErrRunnerClosed = errors.New("queue runner closed")
+
 type QueueRunner struct {
-	client    *redis.Client
+	ctx       context.Context // cancelled when Shutdown returns
+	cancel    context.CancelFunc
+	closeCtx  context.Context // cancelled when Shutdown starts, for waits before reading
+	closeStop context.CancelFunc
+	client    redis.UniversalClient
 	wgs       *queue.Linked[*conc.WaitGroup]
-	closed    bool
+	closeMu   sync.Mutex // orders spawn and Shutdown
+	closing   atomic.Bool
+	closeOnce sync.Once
 	closeChan chan any
+	waitChan  chan any // closed once the goroutines are done, waitErr is set then
+	waitErr   error
+	metrics   Metrics
+	// mkStream lets sends create missing streams
+	mkStream bool
+	queuesMu sync.Mutex
+	queues   map[string]*QueueInfo
+	leader   *leader // nil without election
+	// topics are the partitioned topics sends are routed for
+	topics    map[string]int
+	topicNext atomic.Uint64
 }
 
-func NewQueueRunner(redisClient *redis.Client) *QueueRunner {
+// NewQueueRunner accepts a single node, sentinel or cluster client.
+// With a cluster, the streams of one queue must share a hash tag, e.g. {orders}:a and {orders}:b,
+// keys derived from a stream are tagged to stay on its slot.
+func NewQueueRunner(redisClient redis.UniversalClient, opts ...Option) *QueueRunner {
 	if redisClient == nil {
 		panic("nil client")
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	closeCtx, closeStop := context.WithCancel(ctx)
 	runner := &QueueRunner{
+		ctx:       ctx,
+		cancel:    cancel,
+		closeCtx:  closeCtx,
+		closeStop: closeStop,
 		client:    redisClient,
 		wgs:       queue.NewLinked(make([]*conc.WaitGroup, 0)),
-		closed:    false,
 		closeChan: make(chan any),
+		waitChan:  make(chan any),
+		metrics:   NopMetrics{},
+		queues:    make(map[string]*QueueInfo),
+	}
+	runner.closing.Store(false)
+	for _, opt := range opts {
+		opt(runner)
+	}
+	if runner.leader != nil {
+		runner.runLeader()
 	}
 
 	return runner
@@ -41,49 +83,139 @@ func NewQueueRunner(redisClient *redis.Client) *QueueRunner {
 
 func (qr *QueueRunner) Run(userQueues ...IQueue) error {
 	for _, userQueue := range userQueues {
-		if err := qr.run(userQueue); err != nil {
+		if err := qr.run(userQueue.Info(), queueConsumer{userQueue}.Consume, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (qr *QueueRunner) RunConsumer(consumers ...IConsumer) error {
+	for _, consumer := range consumers {
+		if err := qr.run(consumer.Info(), consumer.Consume, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (qr *QueueRunner) RunBatchConsumer(consumers ...IBatchConsumer) error {
+	for _, consumer := range consumers {
+		if err := qr.run(consumer.Info(), nil, consumer.ConsumeBatch); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (qr *QueueRunner) run(userQueue IQueue) error {
-	info := userQueue.Info()
-	info.handler = userQueue.Handle
+func (qr *QueueRunner) run(info *QueueInfo, handler Handler, batchHandler BatchHandler) error {
+	if qr.closing.Load() {
+		return ErrRunnerClosed
+	}
 	checkQueueInfo(info)
-	if err := qr.init(info); err != nil {
-		return err
+	// partitions are meant to spread over slots, each one runs as a queue of its own
+	if _, ok := qr.client.(*redis.ClusterClient); ok {
+		if info.PartitionInfo == nil {
+			checkSameSlot(info.UserQueueInfo.streams)
+		} else {
+			checkHashTag(info.PartitionInfo.Topic)
+		}
 	}
-	for i := 0; i < info.UserQueueInfo.ConsumerSize; i++ {
-		info.wg.Go(func() { qr.normalRun(info) })
+	if batchHandler != nil && info.UserQueueInfo.WorkerSize > 1 {
+		panic("batch consumer with workers")
 	}
-	if !info.RetryQueueInfo.Stop {
-		info.wg.Go(func() { qr.retryRun(info) })
+	info.handler = handler
+	info.batchHandler = batchHandler
+	checkOrdered(info)
+	if info.PartitionInfo != nil {
+		return qr.runPartitioned(info)
 	}
-	if err := qr.wgs.Offer(info.wg); err != nil {
+	if err := qr.register(info); err != nil {
 		return err
 	}
-
-	return nil
+	if err := qr.init(info); err != nil {
+		qr.unregister(info)
+		return err
+	}
+	info.control.mu.Lock()
+	defer info.control.mu.Unlock()
+	return qr.start(info, info.UserQueueInfo.consumers)
 }
 
 func (qr *QueueRunner) init(info *QueueInfo) error {
-	ctx := context.Background()
+	ctx := qr.ctx
 	for _, stream := range info.UserQueueInfo.streams {
 		_, err := qr.client.XGroupCreateMkStream(ctx, stream, info.UserQueueInfo.Group, info.UserQueueInfo.NewGroupStart).Result()
 		if err != nil && !isBusyGroupErr(err) {
 			return err
 		}
 	}
+	consumers := info.UserQueueInfo.consumers
+	if !info.RetryQueueInfo.Stop {
+		consumers = append(slices.Clip(consumers), info.RetryQueueInfo.consumer)
+	}
+	return qr.createConsumers(ctx, info, consumers)
+}
+
+func (qr *QueueRunner) createConsumers(ctx context.Context, info *QueueInfo, consumers []string) error {
+	for _, stream := range info.UserQueueInfo.streams {
+		for _, consumer := range consumers {
+			if _, err := qr.client.XGroupCreateConsumer(ctx, stream, info.UserQueueInfo.Group, consumer).Result(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// Shutdown stops fetching new messages, waits for the messages already
+// handed to handlers to be handled and acked, and then closes the redis client.
+// If ctx is done before that, the contexts passed to handlers are cancelled,
+// the client is closed anyway and ctx.Err() is returned.
+func (qr *QueueRunner) Shutdown(ctx context.Context) error {
+	// the goroutines are waited for once, concurrent calls share the result
+	qr.closeOnce.Do(func() {
+		qr.closeMu.Lock()
+		qr.closing.Store(true)
+		qr.closeMu.Unlock()
+		close(qr.closeChan)
+		qr.closeStop()
+		go func() {
+			qr.waitErr = qr.wait()
+			close(qr.waitChan)
+		}()
+	})
+
+	select {
+	case <-qr.waitChan:
+		qr.cancel()
+		_ = qr.client.Close()
+		return qr.waitErr
+	case <-ctx.Done():
+		qr.cancel()
+		_ = qr.client.Close()
+		return ctx.Err()
+	}
+}
+
 func (qr *QueueRunner) Close() error {
-	qr.closed = true
-	close(qr.closeChan)
-	_ = qr.client.Close()
+	return qr.Shutdown(context.Background())
+}
+
+// spawn starts goroutines in a new wait group and registers it for Shutdown,
+// unless the runner is closing: Shutdown either waits for them or they are not started.
+func (qr *QueueRunner) spawn(start func(wg *conc.WaitGroup)) error {
+	qr.closeMu.Lock()
+	defer qr.closeMu.Unlock()
+	if qr.closing.Load() {
+		return ErrRunnerClosed
+	}
+	wg := conc.NewWaitGroup()
+	start(wg)
+	return qr.wgs.Offer(wg)
+}
 
+func (qr *QueueRunner) wait() error {
 	var firstErr error
 	for wg := range qr.wgs.Iterator() {
 		if err := wg.WaitAndRecover().AsError(); err != nil && firstErr == nil {
@@ -93,3 +225,13 @@ func (qr *QueueRunner) Close() error {
 
 	return firstErr
 }
+
+// sleep returns early when the runner is closing
+func (qr *QueueRunner) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-qr.closeChan:
+	case <-timer.C:
+	}
+}
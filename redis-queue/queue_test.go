@@ -0,0 +1,184 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/sourcegraph/conc"
+)
+
+// newTestRunner needs no redis, the client is never reached
+func newTestRunner() *QueueRunner {
+	return NewQueueRunner(redis.NewClient(&redis.Options{Addr: "127.0.0.1:0", MaxRetries: -1}))
+}
+
+// newRedisRunner runs on a miniredis closed with the test
+func newRedisRunner(t *testing.T, opts ...Option) (*QueueRunner, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	qr := NewQueueRunner(redis.NewClient(&redis.Options{Addr: mr.Addr()}), opts...)
+	t.Cleanup(func() { _ = qr.Close() })
+	return qr, mr
+}
+
+// testConsumer passes the deliveries to consume
+type testConsumer struct {
+	info    *QueueInfo
+	consume func(ctx context.Context, delivery *Delivery) error
+}
+
+func (c *testConsumer) Info() *QueueInfo {
+	return c.info
+}
+
+func (c *testConsumer) Consume(ctx context.Context, delivery *Delivery) error {
+	return c.consume(ctx, delivery)
+}
+
+type testQueue struct{}
+
+func (testQueue) Info() *QueueInfo {
+	return &QueueInfo{UserQueueInfo: &UserQueueInfo{Streams: []string{"s", ">"}, Group: "g"}}
+}
+
+func (testQueue) Handle(stream, key, val, msgId string) error {
+	return nil
+}
+
+func TestShutdownConcurrent(t *testing.T) {
+	qr := newTestRunner()
+	release := make(chan any)
+	handled := make(chan any)
+	wg := conc.NewWaitGroup()
+	wg.Go(func() {
+		<-release
+		close(handled)
+	})
+	if err := qr.wgs.Offer(wg); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		calls.Add(1)
+		go func() {
+			defer calls.Done()
+			if err := qr.Shutdown(context.Background()); err != nil {
+				t.Error(err)
+			}
+			// no call returns before the goroutines are done
+			select {
+			case <-handled:
+			default:
+				t.Error("Shutdown returned before the goroutines were done")
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if qr.ctx.Err() != nil {
+		t.Error("runner context cancelled while goroutines run")
+	}
+	close(release)
+	calls.Wait()
+
+	if qr.ctx.Err() == nil {
+		t.Error("runner context not cancelled")
+	}
+	if err := qr.Run(testQueue{}); !errors.Is(err, ErrRunnerClosed) {
+		t.Errorf("Run after Shutdown = %v, want %v", err, ErrRunnerClosed)
+	}
+	if err := qr.Close(); err != nil {
+		t.Errorf("Close after Shutdown = %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	qr := newTestRunner()
+	release := make(chan any)
+	defer close(release)
+	wg := conc.NewWaitGroup()
+	wg.Go(func() {
+		select {
+		case <-release:
+		case <-qr.ctx.Done():
+		}
+	})
+	if err := qr.wgs.Offer(wg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := qr.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// the contexts of the handlers are cancelled, so the goroutines end
+	if err := qr.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown = %v", err)
+	}
+}
+
+func TestShutdownPanic(t *testing.T) {
+	qr := newTestRunner()
+	wg := conc.NewWaitGroup()
+	wg.Go(func() {
+		panic("boom")
+	})
+	if err := qr.wgs.Offer(wg); err != nil {
+		t.Fatal(err)
+	}
+	if err := qr.Shutdown(context.Background()); err == nil {
+		t.Error("Shutdown hides the panic of a goroutine")
+	}
+}
+
+func TestSpawnDuringShutdown(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		qr := newTestRunner()
+		var started, finished atomic.Int64
+		var spawners sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			spawners.Add(1)
+			go func() {
+				defer spawners.Done()
+				for {
+					err := qr.spawn(func(wg *conc.WaitGroup) {
+						// widens the window between the closing check and the offer
+						time.Sleep(100 * time.Microsecond)
+						started.Add(1)
+						wg.Go(func() {
+							<-qr.closeChan
+							time.Sleep(time.Millisecond)
+							finished.Add(1)
+						})
+					})
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		if err := qr.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		// every goroutine started before Shutdown returned is done
+		if f, s := finished.Load(), started.Load(); f != s {
+			t.Fatalf("round %d: %d of %d goroutines done when Shutdown returned", round, f, s)
+		}
+		spawners.Wait()
+		if err := qr.spawn(func(wg *conc.WaitGroup) { t.Error("spawned after Shutdown") }); !errors.Is(err, ErrRunnerClosed) {
+			t.Errorf("spawn after Shutdown = %v, want %v", err, ErrRunnerClosed)
+		}
+	}
+}
@@ -6,18 +6,21 @@ package redisqueue
 
 import (
 	"context"
+	"errors"
 	"runtime/debug"
 	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cast"
 )
 
 type retryQueueData struct {
-	deadIds                []string
-	retryIds               []string
-	sendToDeadIds          []string
-	sendToDeadXMessagesMap map[string]any
+	deadIds     []string
+	retryIds    []string
+	retryCounts map[string]int64
+	deliveries  []*Delivery
+	cursors     map[string]string // XAUTOCLAIM cursor of each stream
 
 	running atomic.Bool
 }
@@ -27,12 +30,16 @@ func (data *retryQueueData) reset() {
 	data.deadIds = data.deadIds[:0]
 	clear(data.retryIds)
 	data.retryIds = data.retryIds[:0]
-	clear(data.sendToDeadIds)
-	data.sendToDeadIds = data.sendToDeadIds[:0]
-	clear(data.sendToDeadXMessagesMap)
+	clear(data.retryCounts)
+	data.resetDeliveries()
 }
 
-func (qr *QueueRunner) retryRun(info *QueueInfo) {
+func (data *retryQueueData) resetDeliveries() {
+	clear(data.deliveries)
+	data.deliveries = data.deliveries[:0]
+}
+
+func (qr *QueueRunner) retryRun(info *QueueInfo, stop chan struct{}) {
 	defer func() {
 		if r := recover(); r != nil {
 			info.NotifyPanic(r, string(debug.Stack()))
@@ -40,12 +47,13 @@ func (qr *QueueRunner) retryRun(info *QueueInfo) {
 		}
 	}()
 
-	ctx := context.Background()
+	ctx := qr.ctx
 	data := &retryQueueData{
-		deadIds:                make([]string, 0, info.RetryQueueInfo.BatchSize),
-		retryIds:               make([]string, 0, info.RetryQueueInfo.BatchSize),
-		sendToDeadIds:          make([]string, 0, info.RetryQueueInfo.BatchSize),
-		sendToDeadXMessagesMap: make(map[string]any, 0),
+		deadIds:     make([]string, 0, info.RetryQueueInfo.BatchSize),
+		retryIds:    make([]string, 0, info.RetryQueueInfo.BatchSize),
+		retryCounts: make(map[string]int64, info.RetryQueueInfo.BatchSize),
+		deliveries:  make([]*Delivery, 0, info.RetryQueueInfo.BatchSize),
+		cursors:     make(map[string]string, len(info.UserQueueInfo.streams)),
 	}
 	data.running.Store(false)
 
@@ -55,7 +63,13 @@ func (qr *QueueRunner) retryRun(info *QueueInfo) {
 		case <-qr.closeChan:
 			tick.Stop()
 			return
+		case <-stop:
+			tick.Stop()
+			return
 		case <-tick.C:
+			if info.control.isPaused() || (!info.exclusive && !qr.IsLeader()) {
+				continue
+			}
 			qr.retryHandle(ctx, info, data)
 		}
 	}
@@ -68,39 +82,242 @@ func (qr *QueueRunner) retryHandle(ctx context.Context, info *QueueInfo, data *r
 	defer data.running.Store(false)
 
 	for _, stream := range info.UserQueueInfo.streams {
+		if qr.closing.Load() {
+			break
+		}
 		data.reset()
-		xPendingExts, err := qr.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		qr.collectScheduled(ctx, stream, data, info)
+		qr.claimAndSendToDead(ctx, stream, data, info, 0)
+		qr.claimAndRetry(ctx, stream, data, info, 0)
+
+		qr.autoClaim(ctx, stream, data, info)
+		// ordered keys moved on by dead or deleted messages
+		qr.process(info, nil)
+
+		qr.delStaleConsumers(ctx, stream, info)
+	}
+}
+
+// collectScheduled takes the messages whose scheduled retry time has come,
+// removing them from the schedule first so that only one retry loop handles them.
+func (qr *QueueRunner) collectScheduled(ctx context.Context, stream string, data *retryQueueData, info *QueueInfo) {
+	scheduleName := retryZSetName(stream, info.UserQueueInfo.Group)
+	ids, err := qr.client.ZRangeByScore(ctx, scheduleName, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   cast.ToString(time.Now().UnixMilli()),
+		Count: info.RetryQueueInfo.BatchSize,
+	}).Result()
+	if err != nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	pipe := qr.client.Pipeline()
+	remCmds := make([]*redis.IntCmd, 0, len(ids))
+	pendingCmds := make([]*redis.XPendingExtCmd, 0, len(ids))
+	for _, id := range ids {
+		remCmds = append(remCmds, pipe.ZRem(ctx, scheduleName, id))
+		pendingCmds = append(pendingCmds, pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
 			Stream: stream,
 			Group:  info.UserQueueInfo.Group,
-			Idle:   info.RetryQueueInfo.MinIdleTime,
-			Start:  "-",
-			End:    "+",
-			Count:  info.RetryQueueInfo.BatchSize,
-		}).Result()
-		if qr.closed {
-			break
+			Start:  id,
+			End:    id,
+			Count:  1,
+		}))
+	}
+	if _, err = pipe.Exec(ctx); err != nil && err != redis.Nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		return
+	}
+	for i := range ids {
+		if remCmds[i].Val() == 0 {
+			continue
+		}
+		// already acked
+		if len(pendingCmds[i].Val()) == 0 {
+			continue
 		}
+		data.collect(pendingCmds[i].Val()[0], info)
+	}
+}
+
+// autoClaim walks the pending messages idle longer than MinIdleTime with XAUTOCLAIM,
+// up to MaxPerTick of them, the next tick goes on where this one stopped.
+func (qr *QueueRunner) autoClaim(ctx context.Context, stream string, data *retryQueueData, info *QueueInfo) {
+	cursor := data.cursors[stream]
+	if cursor == "" {
+		cursor = "0-0"
+	}
+	var examined int64
+	for examined < info.RetryQueueInfo.MaxPerTick && !qr.closing.Load() {
+		count := min(info.RetryQueueInfo.BatchSize, info.RetryQueueInfo.MaxPerTick-examined)
+		ids, deletedIds, next, err := qr.xAutoClaimJustID(ctx, stream, info, cursor, count)
 		if err != nil {
-			if err == redis.ErrClosed {
-				continue
+			if err != redis.ErrClosed {
+				info.NotifyErr(stream, "", err)
 			}
-			info.NotifyErr("", "", err)
+			break
+		}
+		examined += int64(len(ids) + len(deletedIds))
+		qr.recordDeleted(info, stream, deletedIds)
+
+		data.reset()
+		qr.collectClaimed(ctx, stream, data, info, ids)
+		qr.claimAndSendToDead(ctx, stream, data, info, 0)
+		qr.claimAndRetry(ctx, stream, data, info, 0)
+
+		cursor = next
+		if cursor == "0-0" {
+			break
+		}
+	}
+	data.cursors[stream] = cursor
+}
+
+// xAutoClaimJustID claims idle messages for the retry consumer without counting a delivery,
+// the client drops the IDs of deleted entries that Redis 7 returns, so it is sent raw.
+func (qr *QueueRunner) xAutoClaimJustID(ctx context.Context, stream string, info *QueueInfo, cursor string, count int64) (ids, deletedIds []string, next string, err error) {
+	result, err := qr.client.Do(ctx, "XAUTOCLAIM", stream, info.UserQueueInfo.Group, info.RetryQueueInfo.consumer,
+		info.RetryQueueInfo.MinIdleTime.Milliseconds(), cursor, "COUNT", count, "JUSTID").Slice()
+	if err != nil {
+		return nil, nil, cursor, err
+	}
+	if len(result) < 2 {
+		return nil, nil, cursor, errors.New("unexpected XAUTOCLAIM reply")
+	}
+	next = cast.ToString(result[0])
+	ids = cast.ToStringSlice(result[1])
+	if len(result) > 2 {
+		deletedIds = cast.ToStringSlice(result[2])
+	}
+	return ids, deletedIds, next, nil
+}
+
+// collectClaimed sorts the claimed messages by their delivery count,
+// the scheduled ones are left to collectScheduled.
+func (qr *QueueRunner) collectClaimed(ctx context.Context, stream string, data *retryQueueData, info *QueueInfo, ids []string) {
+	ids = qr.filterHeads(ctx, stream, info, ids)
+	if len(ids) == 0 {
+		return
+	}
+	scores, err := qr.client.ZMScore(ctx, retryZSetName(stream, info.UserQueueInfo.Group), ids...).Result()
+	if err != nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		return
+	}
+	pipe := qr.client.Pipeline()
+	pendingCmds := make([]*redis.XPendingExtCmd, len(ids))
+	for i, id := range ids {
+		if scores[i] != 0 {
 			continue
 		}
-		for _, xPendingExt := range xPendingExts {
-			if xPendingExt.RetryCount > info.RetryQueueInfo.MinRetry {
-				data.deadIds = append(data.deadIds, xPendingExt.ID)
-				continue
-			}
-			data.retryIds = append(data.retryIds, xPendingExt.ID)
+		pendingCmds[i] = pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  info.UserQueueInfo.Group,
+			Start:  id,
+			End:    id,
+			Count:  1,
+		})
+	}
+	if pipe.Len() == 0 {
+		return
+	}
+	if _, err = pipe.Exec(ctx); err != nil && err != redis.Nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		return
+	}
+	for _, pendingCmd := range pendingCmds {
+		if pendingCmd == nil || len(pendingCmd.Val()) == 0 {
+			continue
+		}
+		data.collect(pendingCmd.Val()[0], info)
+	}
+}
+
+// recordDeleted forgets pending messages whose entries were deleted from the stream
+func (qr *QueueRunner) recordDeleted(info *QueueInfo, stream string, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	pipe := qr.client.Pipeline()
+	pipe.XAck(qr.ctx, stream, info.UserQueueInfo.Group, ids...)
+	pipe.ZRem(qr.ctx, retryZSetName(stream, info.UserQueueInfo.Group), ids)
+	qr.pipeClearMeta(pipe, info, stream, ids...)
+	if _, err := pipe.Exec(qr.ctx); err != nil {
+		if err != redis.ErrClosed {
+			info.NotifyErr(stream, "", err)
+		}
+		return
+	}
+	qr.leaveDeleted(info, stream, ids)
+	for _, id := range ids {
+		info.RetryQueueInfo.NotifyDeleted(stream, id)
+	}
+}
+
+// missingIds returns the ids missing from the XCLAIM reply, their entries were deleted
+func missingIds(ids []string, xMessages []redis.XMessage) []string {
+	if len(xMessages) == len(ids) {
+		return nil
+	}
+	claimed := make(map[string]struct{}, len(xMessages))
+	for _, xMessage := range xMessages {
+		claimed[xMessage.ID] = struct{}{}
+	}
+	deleted := make([]string, 0, len(ids)-len(xMessages))
+	for _, id := range ids {
+		if _, ok := claimed[id]; !ok {
+			deleted = append(deleted, id)
 		}
-		// Messages that have been deleted do not appear in the XClaim return result
-		qr.claimAndSendToDead(ctx, stream, data, info)
-		qr.claimAndRetry(ctx, stream, data, info)
 	}
+	return deleted
+}
+
+func (data *retryQueueData) collect(xPendingExt redis.XPendingExt, info *QueueInfo) {
+	data.retryCounts[xPendingExt.ID] = xPendingExt.RetryCount
+	if xPendingExt.RetryCount > info.RetryQueueInfo.MinRetry {
+		data.deadIds = append(data.deadIds, xPendingExt.ID)
+		return
+	}
+	data.retryIds = append(data.retryIds, xPendingExt.ID)
 }
 
-func (qr *QueueRunner) claimAndSendToDead(ctx context.Context, stream string, data *retryQueueData, info *QueueInfo) {
+// delStaleConsumers deletes consumers of other processes that stay idle without pending messages,
+// their pending messages have been claimed by the retry loop before.
+func (qr *QueueRunner) delStaleConsumers(ctx context.Context, stream string, info *QueueInfo) {
+	xInfoConsumers, err := qr.client.XInfoConsumers(ctx, stream, info.UserQueueInfo.Group).Result()
+	if err != nil {
+		if err == redis.ErrClosed {
+			return
+		}
+		info.NotifyErr(stream, "", err)
+		return
+	}
+	for _, xInfoConsumer := range xInfoConsumers {
+		if xInfoConsumer.Pending > 0 || xInfoConsumer.Idle < info.UserQueueInfo.StaleConsumerIdle {
+			continue
+		}
+		if xInfoConsumer.Name == info.RetryQueueInfo.consumer || info.control.owns(xInfoConsumer.Name) {
+			continue
+		}
+		if _, err := qr.client.XGroupDelConsumer(ctx, stream, info.UserQueueInfo.Group, xInfoConsumer.Name).Result(); err != nil {
+			info.NotifyErr(stream, "", err)
+		}
+	}
+}
+
+func (qr *QueueRunner) claimAndSendToDead(ctx context.Context, stream string, data *retryQueueData, info *QueueInfo, minIdle time.Duration) {
 	if len(data.deadIds) == 0 {
 		return
 	}
@@ -108,12 +325,9 @@ func (qr *QueueRunner) claimAndSendToDead(ctx context.Context, stream string, da
 		Stream:   stream,
 		Group:    info.UserQueueInfo.Group,
 		Consumer: info.RetryQueueInfo.consumer,
-		MinIdle:  info.RetryQueueInfo.MinIdleTime,
+		MinIdle:  minIdle,
 		Messages: data.deadIds,
 	}).Result()
-	if qr.closed {
-		return
-	}
 	if err != nil {
 		if err == redis.ErrClosed {
 			return
@@ -121,36 +335,27 @@ func (qr *QueueRunner) claimAndSendToDead(ctx context.Context, stream string, da
 		info.NotifyErr("", "", err)
 		return
 	}
+	qr.recordDeleted(info, stream, missingIds(data.deadIds, xMessages))
 	if len(xMessages) == 0 {
 		return
 	}
 
+	data.resetDeliveries()
 	for _, xMessage := range xMessages {
-		data.sendToDeadIds = append(data.sendToDeadIds, xMessage.ID)
-		xMessageStr, _ := json.MarshalToString(xMessage)
-		data.sendToDeadXMessagesMap[xMessage.ID] = xMessageStr
-	}
-	if !info.DeadQueueInfo.Stop {
-		// send to dead hash
-		if _, err := qr.client.HSet(ctx, deadHashMapName(stream, info.UserQueueInfo.Group), data.sendToDeadXMessagesMap).Result(); err != nil {
-			if err == redis.ErrClosed {
-				return
-			}
-			info.NotifyErr(stream, "", err)
-			return
-		}
-	}
-	if _, err = qr.client.XAck(ctx, stream, info.UserQueueInfo.Group, data.sendToDeadIds...).Result(); err != nil {
-		info.NotifyErr(stream, "", err)
-		return
-	}
-	for _, xMessage := range xMessages {
-		key, val := extractValues(xMessage.Values)
-		info.RetryQueueInfo.NotifyDead(stream, key, val, xMessage.ID)
+		delivery := newDelivery(info, info.RetryQueueInfo.consumer, stream, xMessage)
+		delivery.RetryCount = data.retryCounts[xMessage.ID]
+		data.deliveries = append(data.deliveries, delivery)
 	}
+	qr.loadFirstDeliveries(info, stream, data.deliveries)
+	qr.sendToDead(info, DeadReasonMaxRetry, nil, data.deliveries...)
 }
 
-func (qr *QueueRunner) claimAndRetry(ctx context.Context, stream string, data *retryQueueData, info *QueueInfo) {
+func (qr *QueueRunner) claimAndRetry(ctx context.Context, stream string, data *retryQueueData, info *QueueInfo, minIdle time.Duration) {
+	if len(data.retryIds) == 0 {
+		return
+	}
+	// the ones beyond the limiter tokens stay pending for a later tick
+	data.retryIds = data.retryIds[:qr.take(info, len(data.retryIds))]
 	if len(data.retryIds) == 0 {
 		return
 	}
@@ -158,12 +363,11 @@ func (qr *QueueRunner) claimAndRetry(ctx context.Context, stream string, data *r
 		Stream:   stream,
 		Group:    info.UserQueueInfo.Group,
 		Consumer: info.RetryQueueInfo.consumer,
-		MinIdle:  info.RetryQueueInfo.MinIdleTime,
+		MinIdle:  minIdle,
 		Messages: data.retryIds,
 	}).Result()
-	if qr.closed {
-		return
-	}
+	// acked or no longer idle meanwhile
+	qr.giveBack(info, len(data.retryIds)-len(xMessages))
 	if err != nil {
 		if err == redis.ErrClosed {
 			return
@@ -171,15 +375,14 @@ func (qr *QueueRunner) claimAndRetry(ctx context.Context, stream string, data *r
 		info.NotifyErr("", "", err)
 		return
 	}
+	qr.recordDeleted(info, stream, missingIds(data.retryIds, xMessages))
+	data.resetDeliveries()
 	for _, xMessage := range xMessages {
-		key, val := extractValues(xMessage.Values)
-		if err := info.handler(stream, key, val, xMessage.ID); err != nil {
-			info.NotifyErr(stream, key, err)
-			continue
-		}
-		if _, err = qr.client.XAck(ctx, stream, info.UserQueueInfo.Group, xMessage.ID).Result(); err != nil {
-			info.NotifyErr(stream, key, err)
-			continue
-		}
+		delivery := newDelivery(info, info.RetryQueueInfo.consumer, stream, xMessage)
+		delivery.RetryCount = data.retryCounts[xMessage.ID]
+		data.deliveries = append(data.deliveries, delivery)
 	}
+	qr.loadFirstDeliveries(info, stream, data.deliveries)
+	qr.metrics.Retried(stream, info.UserQueueInfo.Group, len(data.deliveries))
+	qr.process(info, data.deliveries)
 }
@@ -0,0 +1,214 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+type redisScriptEnum int32
+
+const (
+	scriptMoveDelayed redisScriptEnum = iota
+	scriptSendIdempotent
+	scriptLimit
+	scriptLimitReturn
+	scriptOrderedRead
+	scriptOrderLeave
+)
+
+// Scripts touch keys derived from one stream, which share its slot in cluster,
+// all of them are passed in KEYS except the order zsets named after message keys.
+const (
+	// KEYS[1] delay zset, KEYS[2] delay hash, KEYS[3] stream
+	// ARGV[1] now in ms, ARGV[2] batch size, ARGV[3] 1 to create the stream
+	// returns {moved, 1 when the stream does not exist}
+	scriptMoveDelayedStr string = `local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+local moved = 0
+for _, id in ipairs(ids) do
+	local data = redis.call('HGET', KEYS[2], id)
+	if data then
+		local added
+		if ARGV[3] == '1' then
+			added = redis.call('XADD', KEYS[3], '*', unpack(cmsgpack.unpack(data)))
+		else
+			added = redis.call('XADD', KEYS[3], 'NOMKSTREAM', '*', unpack(cmsgpack.unpack(data)))
+		end
+		if not added then
+			return {moved, 1}
+		end
+	end
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('HDEL', KEYS[2], id)
+	moved = moved + 1
+end
+return {moved, 0}`
+	// KEYS[1] idempotency key, KEYS[2] stream
+	// ARGV[1] window in ms, ARGV[2] 1 to create the stream, ARGV[3:] fields
+	// returns {1, new id}, {0, existing id} or {2} when the stream does not exist
+	scriptSendIdempotentStr string = `local id = redis.call('GET', KEYS[1])
+if id then
+	return {0, id}
+end
+if ARGV[2] == '1' then
+	id = redis.call('XADD', KEYS[2], '*', unpack(ARGV, 3))
+else
+	id = redis.call('XADD', KEYS[2], 'NOMKSTREAM', '*', unpack(ARGV, 3))
+end
+if not id then
+	return {2}
+end
+redis.call('SET', KEYS[1], id, 'PX', ARGV[1])
+return {1, id}`
+	// KEYS[1] limiter
+	// ARGV[1] ms per token, ARGV[2] burst, ARGV[3] max tokens to take
+	// returns {tokens taken, 0} or {0, ms to wait for a token}
+	scriptLimitStr string = `local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local available = burst - math.ceil((tat - now) / interval)
+if available <= 0 then
+	return {0, math.ceil(tat - now - (burst - 1) * interval)}
+end
+local taken = math.min(tonumber(ARGV[3]), available)
+tat = tat + taken * interval
+redis.call('SET', KEYS[1], tostring(tat), 'PX', math.ceil(tat - now))
+return {taken, 0}`
+	// KEYS[1] limiter
+	// ARGV[1] ms per token, ARGV[2] tokens to give back
+	scriptLimitReturnStr string = `local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local tat = tonumber(redis.call('GET', KEYS[1]) or now) - tonumber(ARGV[2]) * tonumber(ARGV[1])
+if tat <= now then
+	redis.call('DEL', KEYS[1])
+	return 0
+end
+redis.call('SET', KEYS[1], tostring(tat), 'PX', math.ceil(tat - now))
+return 0`
+	// KEYS streams
+	// ARGV[1] group, ARGV[2] consumer, ARGV[3] count, then the ID and the order hash of each stream
+	// returns {1, XREADGROUP reply without the entries waiting for their key} or {0, last entry ID of each stream}.
+	// The order zsets are named <order hash>:<key>, undeclared but on the slot of their stream.
+	scriptOrderedReadStr string = `local n = #KEYS
+local args = {'XREADGROUP', 'GROUP', ARGV[1], ARGV[2], 'COUNT', ARGV[3], 'STREAMS'}
+for i = 1, n do
+	args[#args + 1] = KEYS[i]
+end
+for i = 1, n do
+	args[#args + 1] = ARGV[3 + i]
+end
+local streams = redis.call(unpack(args))
+if not streams then
+	local last = {}
+	for i = 1, n do
+		local entry = redis.call('XREVRANGE', KEYS[i], '+', '-', 'COUNT', 1)[1]
+		last[i] = entry and entry[1] or '0-0'
+	end
+	return {0, last}
+end
+local function pad(s)
+	return string.rep('0', 20 - #s) .. s
+end
+-- an entry behind an older one of its key is left pending, the ack of its predecessor claims it
+for _, stream in ipairs(streams) do
+	local hash
+	for i = 1, n do
+		if KEYS[i] == stream[1] then
+			hash = ARGV[3 + n + i]
+		end
+	end
+	local heads = {}
+	for _, entry in ipairs(stream[2]) do
+		local fields = entry[2]
+		local head = true
+		for j = 1, #fields, 2 do
+			if fields[j] == 'key' then
+				local ms, seq = string.match(entry[1], '^(%d+)-(%d+)$')
+				local zset = hash .. ':' .. fields[j + 1]
+				local padded = pad(ms) .. '-' .. pad(seq)
+				redis.call('ZADD', zset, 0, padded)
+				redis.call('HSET', hash, entry[1], fields[j + 1])
+				head = redis.call('ZRANGE', zset, 0, 0)[1] == padded
+				break
+			end
+		end
+		if head then
+			heads[#heads + 1] = entry
+		end
+	end
+	stream[2] = heads
+end
+return {1, streams}`
+	// KEYS[1] order zset, KEYS[2] order hash, KEYS[3] stream
+	// ARGV[1] padded ID, ARGV[2] ID, ARGV[3] group, ARGV[4] consumer
+	// returns the next entry of the key claimed for the consumer, or nil
+	scriptOrderLeaveStr string = `redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[2])
+while true do
+	local head = redis.call('ZRANGE', KEYS[1], 0, 0)[1]
+	if not head then
+		return false
+	end
+	local ms, seq = string.match(head, '^0*(%d+)-0*(%d+)$')
+	local id = ms .. '-' .. seq
+	-- JUSTID does not count a delivery, the entry was left pending unhandled
+	local claimed = redis.call('XCLAIM', KEYS[3], ARGV[3], ARGV[4], 0, id, 'JUSTID')
+	if claimed[1] then
+		local entry = redis.call('XRANGE', KEYS[3], id, id)[1]
+		if entry then
+			return entry
+		end
+	end
+	-- acked or deleted, it does not hold the key
+	redis.call('ZREM', KEYS[1], head)
+	redis.call('HDEL', KEYS[2], id)
+end`
+)
+
+var scriptDic = make(map[redisScriptEnum]string, 5)
+var hashDic = make(map[redisScriptEnum]string, 5)
+
+func init() {
+	scriptDic[scriptMoveDelayed] = scriptMoveDelayedStr
+	scriptDic[scriptSendIdempotent] = scriptSendIdempotentStr
+	scriptDic[scriptLimit] = scriptLimitStr
+	scriptDic[scriptLimitReturn] = scriptLimitReturnStr
+	scriptDic[scriptOrderedRead] = scriptOrderedReadStr
+	scriptDic[scriptOrderLeave] = scriptOrderLeaveStr
+
+	initHash()
+}
+
+func initHash() {
+	for k, v := range scriptDic {
+		h := sha1.New()
+		h.Write([]byte(v))
+		hashDic[k] = hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+func (enumCode redisScriptEnum) getScript() string {
+	return scriptDic[enumCode]
+}
+
+func (enumCode redisScriptEnum) getHash() string {
+	return hashDic[enumCode]
+}
+
+func (qr *QueueRunner) evalScript(ctx context.Context, script redisScriptEnum, keys []string, args ...any) (any, error) {
+	result, err := qr.client.EvalSha(ctx, script.getHash(), keys, args...).Result()
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		result, err = qr.client.Eval(ctx, script.getScript(), keys, args...).Result()
+	}
+	return result, err
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrGroupNotFound = errors.New("group not found")
+
+type ConsumerStats struct {
+	Name    string        `json:"name"`
+	Pending int64         `json:"pending"`
+	Idle    time.Duration `json:"idle"`
+}
+
+type QueueStats struct {
+	Stream          string           `json:"stream"`
+	Group           string           `json:"group"`
+	Length          int64            `json:"length"`
+	FirstID         string           `json:"first_id"`
+	LastID          string           `json:"last_id"`
+	LastDeliveredID string           `json:"last_delivered_id"`
+	Lag             int64            `json:"lag"`
+	Pending         int64            `json:"pending"`
+	Consumers       []*ConsumerStats `json:"consumers"`
+	// OldestPendingAge is the time since the oldest pending message was added
+	OldestPendingID  string        `json:"oldest_pending_id"`
+	OldestPendingAge time.Duration `json:"oldest_pending_age"`
+	DeadLength       int64         `json:"dead_length"`
+	DelayedLength    int64         `json:"delayed_length"`
+}
+
+// Stats describes the stream and the group, Lag needs redis 7.
+func (qr *QueueRunner) Stats(ctx context.Context, stream, group string) (*QueueStats, error) {
+	if stream == "" || group == "" {
+		return nil, errors.New("invalid params")
+	}
+	pipe := qr.client.Pipeline()
+	streamCmd := pipe.XInfoStream(ctx, stream)
+	groupsCmd := pipe.XInfoGroups(ctx, stream)
+	consumersCmd := pipe.XInfoConsumers(ctx, stream, group)
+	pendingCmd := pipe.XPending(ctx, stream, group)
+	deadCmd := pipe.XLen(ctx, deadStreamName(stream, group))
+	delayedCmd := pipe.ZCard(ctx, delayZSetName(stream))
+	_, _ = pipe.Exec(ctx)
+
+	xInfoStream, err := streamCmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	stats := &QueueStats{
+		Stream:    stream,
+		Group:     group,
+		Length:    xInfoStream.Length,
+		FirstID:   xInfoStream.FirstEntry.ID,
+		LastID:    xInfoStream.LastEntry.ID,
+		Consumers: make([]*ConsumerStats, 0),
+	}
+
+	xInfoGroups, err := groupsCmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, xInfoGroup := range xInfoGroups {
+		if xInfoGroup.Name != group {
+			continue
+		}
+		found = true
+		stats.LastDeliveredID = xInfoGroup.LastDeliveredID
+		stats.Lag = xInfoGroup.Lag
+		stats.Pending = xInfoGroup.Pending
+	}
+	if !found {
+		return nil, ErrGroupNotFound
+	}
+
+	xInfoConsumers, err := consumersCmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, xInfoConsumer := range xInfoConsumers {
+		stats.Consumers = append(stats.Consumers, &ConsumerStats{
+			Name:    xInfoConsumer.Name,
+			Pending: xInfoConsumer.Pending,
+			Idle:    xInfoConsumer.Idle,
+		})
+	}
+
+	xPending, err := pendingCmd.Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if xPending != nil && xPending.Count > 0 {
+		stats.OldestPendingID = xPending.Lower
+		stats.OldestPendingAge = time.Since(idTime(xPending.Lower))
+	}
+
+	if stats.DeadLength, err = deadCmd.Result(); err != nil {
+		return nil, err
+	}
+	if stats.DelayedLength, err = delayedCmd.Result(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// StatsHandler serves Stats as JSON, the stream and group are read from the query,
+// e.g. router.GET("/queue/stats", redisqueue.StatsHandler(runner)) serves /queue/stats?stream=s&group=g
+func StatsHandler(qr *QueueRunner) gin.HandlerFunc {
+	return func(gtx *gin.Context) {
+		stream, group := gtx.Query("stream"), gtx.Query("group")
+		if stream == "" || group == "" {
+			gtx.JSON(http.StatusBadRequest, gin.H{"error": "stream and group are required"})
+			return
+		}
+		stats, err := qr.Stats(gtx.Request.Context(), stream, group)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrGroupNotFound) {
+				status = http.StatusNotFound
+			}
+			gtx.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		gtx.JSON(http.StatusOK, stats)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StreamTier is a group of streams read before the streams of the tiers after it
+type StreamTier struct {
+	// Streams are pairs of names and IDs like UserQueueInfo.Streams
+	Streams []string
+	// Weight is the share of reads trying this tier first, whatever the tiers before it hold,
+	// so a flood on a higher tier does not starve it. Zero means the tier is only read
+	// when the tiers before it are empty, if all weights are zero the priority is strict.
+	Weight int
+}
+
+// checkTiers fills UserQueueInfo.Streams with the streams of all tiers
+func checkTiers(userQueueInfo *UserQueueInfo) {
+	if len(userQueueInfo.Tiers) == 0 {
+		return
+	}
+	if len(userQueueInfo.Streams) > 0 && !userQueueInfo.tiered {
+		panic("both streams and tiers")
+	}
+	names := make([]string, 0)
+	ids := make([]string, 0)
+	for _, tier := range userQueueInfo.Tiers {
+		if tier == nil || len(tier.Streams) == 0 {
+			panic("empty tier")
+		}
+		if len(tier.Streams)%2 != 0 {
+			panic("invalid tier streams")
+		}
+		if tier.Weight < 0 {
+			panic("invalid tier weight")
+		}
+		half := len(tier.Streams) / 2
+		names = append(names, tier.Streams[:half]...)
+		ids = append(ids, tier.Streams[half:]...)
+	}
+	userQueueInfo.Streams = append(names, ids...)
+	userQueueInfo.tiered = true
+}
+
+// tierPicker picks the tier tried first by smooth weighted round-robin,
+// each consumer has its own.
+type tierPicker struct {
+	weights []int
+	current []int
+	total   int
+}
+
+// newTierPicker returns nil when no tier has a weight
+func newTierPicker(tiers []*StreamTier) *tierPicker {
+	picker := &tierPicker{
+		weights: make([]int, len(tiers)),
+		current: make([]int, len(tiers)),
+	}
+	for i, tier := range tiers {
+		picker.weights[i] = tier.Weight
+		picker.total += tier.Weight
+	}
+	if picker.total == 0 {
+		return nil
+	}
+	return picker
+}
+
+func (picker *tierPicker) next() int {
+	if picker == nil {
+		return -1
+	}
+	best := -1
+	for i, weight := range picker.weights {
+		if weight == 0 {
+			continue
+		}
+		picker.current[i] += weight
+		if best < 0 || picker.current[i] > picker.current[best] {
+			best = i
+		}
+	}
+	picker.current[best] -= picker.total
+	return best
+}
+
+// read reads the tiers in order without blocking, starting with the one picked by the picker,
+// and blocks on all streams only when they are all empty.
+func (qr *QueueRunner) read(info *QueueInfo, consumer string, picker *tierPicker, count int64) ([]redis.XStream, error) {
+	tiers := info.UserQueueInfo.Tiers
+	if len(tiers) > 0 {
+		first := picker.next()
+		if first >= 0 {
+			xStreams, err := qr.readGroup(info, consumer, tiers[first].Streams, count, -1)
+			if err != redis.Nil {
+				return xStreams, err
+			}
+		}
+		for i, tier := range tiers {
+			if i == first {
+				continue
+			}
+			xStreams, err := qr.readGroup(info, consumer, tier.Streams, count, -1)
+			if err != redis.Nil {
+				return xStreams, err
+			}
+		}
+	}
+	return qr.readGroup(info, consumer, info.UserQueueInfo.Streams, count, info.UserQueueInfo.Block)
+}
+
+// readGroup returns redis.Nil when nothing is read, block < 0 does not block
+func (qr *QueueRunner) readGroup(info *QueueInfo, consumer string, streams []string, count int64, block time.Duration) ([]redis.XStream, error) {
+	return qr.client.XReadGroup(qr.ctx, &redis.XReadGroupArgs{
+		Group:    info.UserQueueInfo.Group,
+		Consumer: consumer,
+		Streams:  streams,
+		Count:    count,
+		Block:    block,
+		NoAck:    false,
+	}).Result()
+}
@@ -0,0 +1,44 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTierPicker(t *testing.T) {
+	picker := newTierPicker([]*StreamTier{{Weight: 5}, {Weight: 1}, {Weight: 1}})
+	got := make([]int, 0, 7)
+	for i := 0; i < 7; i++ {
+		got = append(got, picker.next())
+	}
+	// smooth: the heavy tier does not take its 5 picks in a row
+	want := []int{0, 0, 1, 0, 2, 0, 0}
+	if !slices.Equal(got, want) {
+		t.Errorf("picks %v, want %v", got, want)
+	}
+}
+
+func TestTierPickerCounts(t *testing.T) {
+	picker := newTierPicker([]*StreamTier{{Weight: 3}, {Weight: 0}, {Weight: 2}})
+	counts := make([]int, 3)
+	for i := 0; i < 500; i++ {
+		counts[picker.next()]++
+	}
+	if want := []int{300, 0, 200}; !slices.Equal(counts, want) {
+		t.Errorf("counts %v, want %v", counts, want)
+	}
+}
+
+func TestTierPickerWithoutWeights(t *testing.T) {
+	picker := newTierPicker([]*StreamTier{{}, {}})
+	if picker != nil {
+		t.Fatal("picker without weights")
+	}
+	if got := picker.next(); got != -1 {
+		t.Errorf("nil picker picks %d, want -1", got)
+	}
+}
@@ -4,25 +4,69 @@
 
 package redisqueue
 
-import "strings"
+import (
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+)
 
 const (
-	keyStr = "key"
-	valStr = "val"
+	keyStr  = "key"
+	valStr  = "val"
+	ctStr   = "ct"   // content type
+	idemStr = "idem" // idempotency key
 )
 
-func extractValues(values map[string]interface{}) (key, val string) {
-	if values == nil {
-		return
+var hostname = sync.OnceValue[string](func() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "unknown"
 	}
-	if v, ok := values[keyStr].(string); ok {
-		key = v
+	return name
+})
+
+func consumerName(prefix string) string {
+	return prefix + "-" + hostname() + "-" + strconv.Itoa(os.Getpid())
+}
+
+// idTime returns the time part of a stream entry ID
+func idTime(id string) time.Time {
+	ms, _, _ := strings.Cut(id, "-")
+	return time.UnixMilli(cast.ToInt64(ms))
+}
+
+// parseStreamID splits a stream entry ID, "+" is the greatest
+func parseStreamID(id string) (ms, seq uint64) {
+	if id == "+" {
+		return math.MaxUint64, math.MaxUint64
 	}
-	if v, ok := values[valStr].(string); ok {
-		val = v
+	msStr, seqStr, _ := strings.Cut(id, "-")
+	// cast parses through int64 and loses the sequences above it
+	ms, _ = strconv.ParseUint(msStr, 10, 64)
+	seq, _ = strconv.ParseUint(seqStr, 10, 64)
+	return ms, seq
+}
+
+func nextStreamID(id string) string {
+	ms, seq := parseStreamID(id)
+	if seq == math.MaxUint64 {
+		return strconv.FormatUint(ms+1, 10) + "-0"
 	}
+	return strconv.FormatUint(ms, 10) + "-" + strconv.FormatUint(seq+1, 10)
+}
 
-	return
+func minStreamID(a, b string) string {
+	aMs, aSeq := parseStreamID(a)
+	bMs, bSeq := parseStreamID(b)
+	if aMs < bMs || (aMs == bMs && aSeq <= bSeq) {
+		return a
+	}
+	return b
 }
 
 func extractStreamNames(streams []string) []string {
@@ -30,10 +74,105 @@ func extractStreamNames(streams []string) []string {
 	return streams[:streamLen]
 }
 
-func deadHashMapName(stream, group string) string {
+func deadStreamName(stream, group string) string {
+	return hashTag(stream) + "-dlq-" + group
+}
+
+// legacyDeadHashName is the dead hash of the former releases, see MigrateLegacyDead
+func legacyDeadHashName(stream, group string) string {
 	return stream + "-dead-" + group
 }
 
+func metaHashName(stream, group string) string {
+	return hashTag(stream) + "-meta-" + group
+}
+
+func errorListName(stream, group, id string) string {
+	return hashTag(stream) + "-errors-" + group + ":" + id
+}
+
+func retryZSetName(stream, group string) string {
+	return hashTag(stream) + "-retry-" + group
+}
+
+func delayZSetName(stream string) string {
+	return hashTag(stream) + "-delay"
+}
+
+func delayHashName(stream string) string {
+	return hashTag(stream) + "-delay-data"
+}
+
+func dedupeKeyName(stream, group, id string) string {
+	return hashTag(stream) + "-dedupe-" + group + ":" + id
+}
+
+func idempotencyKeyName(stream, idempotencyKey string) string {
+	return hashTag(stream) + "-idempotency:" + idempotencyKey
+}
+
+// hashTag makes the keys derived from the stream land on its slot,
+// a stream with a hash tag keeps it, others become one, so "orders" derives "{orders}-...".
+// A stream with "}" but no hash tag cannot become one, checkHashTag rejects it in cluster.
+func hashTag(stream string) string {
+	if _, ok := hashTagOf(stream); ok {
+		return stream
+	}
+	return "{" + stream + "}"
+}
+
+// hashTagOf returns the part of the key that redis cluster hashes
+func hashTagOf(key string) (string, bool) {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key, false
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key, false
+	}
+	return key[start+1 : start+1+end], true
+}
+
+// checkHashTag panics when the keys derived from the stream would land on another slot
+func checkHashTag(stream string) {
+	if _, ok := hashTagOf(stream); !ok && strings.IndexByte(stream, '}') >= 0 {
+		panic("stream with \"}\" but no hash tag in cluster: " + stream)
+	}
+}
+
+func checkSameSlot(streams []string) {
+	for _, stream := range streams {
+		checkHashTag(stream)
+	}
+	tag, _ := hashTagOf(streams[0])
+	for _, stream := range streams[1:] {
+		if t, _ := hashTagOf(stream); t != tag {
+			panic("streams of a queue must share a hash tag in cluster")
+		}
+	}
+}
+
+func orderHashName(stream, group string) string {
+	return hashTag(stream) + "-order-" + group
+}
+
+func orderZSetName(stream, group, key string) string {
+	return orderHashName(stream, group) + ":" + key
+}
+
+func partitionMembersName(topic, group string) string {
+	return hashTag(topic) + "-members-" + group
+}
+
+func partitionOwnerName(stream, group string) string {
+	return hashTag(stream) + "-owner-" + group
+}
+
+func limiterKeyName(name, key string) string {
+	return name + ":" + key
+}
+
 const busyGroupStr = "BUSYGROUP"
 
 func isBusyGroupErr(err error) bool {
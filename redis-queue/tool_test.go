@@ -0,0 +1,144 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import "testing"
+
+func TestHashTag(t *testing.T) {
+	tests := []struct {
+		stream string
+		want   string
+	}{
+		{"orders", "{orders}"},
+		{"{orders}:a", "{orders}:a"},
+		{"orders:{eu}", "orders:{eu}"},
+		{"orders{", "{orders{}"},
+	}
+	for _, tt := range tests {
+		if got := hashTag(tt.stream); got != tt.want {
+			t.Errorf("hashTag(%q) = %q, want %q", tt.stream, got, tt.want)
+		}
+	}
+}
+
+func TestHashTagOf(t *testing.T) {
+	tests := []struct {
+		key    string
+		want   string
+		tagged bool
+	}{
+		{"orders", "orders", false},
+		{"{orders}:a", "orders", true},
+		{"a{b}{c}", "b", true},
+		{"{}orders", "{}orders", false},
+		{"{orders", "{orders", false},
+	}
+	for _, tt := range tests {
+		got, tagged := hashTagOf(tt.key)
+		if got != tt.want || tagged != tt.tagged {
+			t.Errorf("hashTagOf(%q) = %q, %v, want %q, %v", tt.key, got, tagged, tt.want, tt.tagged)
+		}
+	}
+}
+
+func TestDerivedNamesShareSlot(t *testing.T) {
+	for _, stream := range []string{"orders", "{orders}:a", "orders{"} {
+		want, _ := hashTagOf(stream)
+		for _, name := range []string{
+			deadStreamName(stream, "g"),
+			metaHashName(stream, "g"),
+			errorListName(stream, "g", "1-0"),
+			retryZSetName(stream, "g"),
+			delayZSetName(stream),
+			delayHashName(stream),
+			dedupeKeyName(stream, "g", "1-0"),
+			idempotencyKeyName(stream, "k"),
+			orderHashName(stream, "g"),
+			orderZSetName(stream, "g", "k"),
+			partitionOwnerName(stream, "g"),
+		} {
+			if got, _ := hashTagOf(name); got != want {
+				t.Errorf("%q hashes %q, want %q", name, got, want)
+			}
+		}
+	}
+}
+
+func TestCheckHashTag(t *testing.T) {
+	tests := []struct {
+		stream string
+		valid  bool
+	}{
+		{"orders", true},
+		{"{orders}:a", true},
+		{"orders{", true},
+		// derived keys would hash a part of the stream name only
+		{"orders}", false},
+		{"orders{}", false},
+		{"{}orders", false},
+		{"{}orders{a}", false},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if r := recover(); (r == nil) != tt.valid {
+					t.Errorf("checkHashTag(%q) panic %v, want valid %v", tt.stream, r, tt.valid)
+				}
+			}()
+			checkHashTag(tt.stream)
+		}()
+		if !tt.valid {
+			continue
+		}
+		// a stream passing the check shares the slot of its derived keys
+		want, _ := hashTagOf(tt.stream)
+		if got, _ := hashTagOf(deadStreamName(tt.stream, "g")); got != want {
+			t.Errorf("%q derives keys hashing %q, want %q", tt.stream, got, want)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("checkSameSlot accepted an invalid stream")
+		}
+	}()
+	checkSameSlot([]string{"orders}", "orders}"})
+}
+
+func TestNextStreamID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"0-0", "0-1"},
+		{"1526919030474-55", "1526919030474-56"},
+		{"1526919030474-18446744073709551615", "1526919030475-0"},
+		{"5", "5-1"},
+	}
+	for _, tt := range tests {
+		if got := nextStreamID(tt.id); got != tt.want {
+			t.Errorf("nextStreamID(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestMinStreamID(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"1-0", "2-0", "1-0"},
+		{"2-0", "1-0", "1-0"},
+		{"1-10", "1-9", "1-9"},
+		{"10-0", "9-0", "9-0"},
+		{"1-1", "1-1", "1-1"},
+		{"+", "1-0", "1-0"},
+		{"1-0", "+", "1-0"},
+	}
+	for _, tt := range tests {
+		if got := minStreamID(tt.a, tt.b); got != tt.want {
+			t.Errorf("minStreamID(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/sourcegraph/conc"
 	"github.com/spf13/cast"
 )
@@ -18,31 +19,36 @@ type TrimInfo struct {
 	MaxLen      int64
 	MaxDuration time.Duration
 	Limit       int64
+	// Safe never trims entries that a group has not read or not acked yet,
+	// MaxLen then removes at most Limit entries per tick.
+	Safe       bool
+	NotifyErr  func(stream string, err error)
+	NotifyTrim func(stream string, trimmed int64)
 }
 
 func (qr *QueueRunner) RunTrim(trimInfos ...*TrimInfo) error {
-	wg := conc.NewWaitGroup()
 	for _, trimInfo := range trimInfos {
 		checkTrimInfo(trimInfo)
-		wg.Go(func() {
-			ctx := context.Background()
-			tick := time.NewTicker(trimInfo.Tick)
-			for {
-				select {
-				case <-qr.closeChan:
-					tick.Stop()
-					return
-				case <-tick.C:
-					qr.trimRun(ctx, trimInfo)
-				}
-			}
-		})
-	}
-	if err := qr.wgs.Offer(wg); err != nil {
-		return err
 	}
-
-	return nil
+	return qr.spawn(func(wg *conc.WaitGroup) {
+		for _, trimInfo := range trimInfos {
+			wg.Go(func() {
+				ctx := context.Background()
+				tick := time.NewTicker(trimInfo.Tick)
+				for {
+					select {
+					case <-qr.closeChan:
+						tick.Stop()
+						return
+					case <-tick.C:
+						if qr.IsLeader() {
+							qr.trimRun(ctx, trimInfo)
+						}
+					}
+				}
+			})
+		}
+	})
 }
 
 func checkTrimInfo(info *TrimInfo) {
@@ -72,16 +78,120 @@ func checkTrimInfo(info *TrimInfo) {
 	if info.Limit == 0 {
 		info.Limit = 100
 	}
+	if info.NotifyErr == nil {
+		info.NotifyErr = func(stream string, err error) {}
+	}
+	if info.NotifyTrim == nil {
+		info.NotifyTrim = func(stream string, trimmed int64) {}
+	}
 }
 
 func (qr *QueueRunner) trimRun(ctx context.Context, trimInfo *TrimInfo) {
 	for _, stream := range trimInfo.Streams {
-		if trimInfo.MaxLen > 0 {
-			qr.client.XTrimMaxLenApprox(ctx, stream, trimInfo.MaxLen, trimInfo.Limit)
+		if qr.closing.Load() {
+			return
+		}
+		var trimmed int64
+		var err error
+		if trimInfo.Safe {
+			trimmed, err = qr.safeTrim(ctx, stream, trimInfo)
+		} else {
+			trimmed, err = qr.trim(ctx, stream, trimInfo)
+		}
+		if err != nil && err != redis.ErrClosed {
+			trimInfo.NotifyErr(stream, err)
+		}
+		if trimmed > 0 {
+			trimInfo.NotifyTrim(stream, trimmed)
+		}
+	}
+}
+
+func (qr *QueueRunner) trim(ctx context.Context, stream string, trimInfo *TrimInfo) (int64, error) {
+	var trimmed int64
+	if trimInfo.MaxLen > 0 {
+		n, err := qr.client.XTrimMaxLenApprox(ctx, stream, trimInfo.MaxLen, trimInfo.Limit).Result()
+		if err != nil {
+			return trimmed, err
+		}
+		trimmed += n
+	}
+	if trimInfo.MaxDuration > 0 {
+		minId := cast.ToString(time.Now().Add(-trimInfo.MaxDuration).UnixMilli())
+		n, err := qr.client.XTrimMinIDApprox(ctx, stream, minId, trimInfo.Limit).Result()
+		if err != nil {
+			return trimmed, err
+		}
+		trimmed += n
+	}
+	return trimmed, nil
+}
+
+// safeTrim trims by MINID only, bounded by the oldest entry still needed by a group
+func (qr *QueueRunner) safeTrim(ctx context.Context, stream string, trimInfo *TrimInfo) (int64, error) {
+	floor, err := qr.SafeTrimID(ctx, stream)
+	if err != nil {
+		return 0, err
+	}
+	var trimmed int64
+	if trimInfo.MaxLen > 0 {
+		n, err := qr.client.XLen(ctx, stream).Result()
+		if err != nil {
+			return trimmed, err
+		}
+		if excess := n - trimInfo.MaxLen; excess > 0 {
+			xMessages, err := qr.client.XRangeN(ctx, stream, "-", "+", min(excess, trimInfo.Limit)).Result()
+			if err != nil {
+				return trimmed, err
+			}
+			if len(xMessages) > 0 {
+				minId := minStreamID(nextStreamID(xMessages[len(xMessages)-1].ID), floor)
+				n, err := qr.client.XTrimMinID(ctx, stream, minId).Result()
+				if err != nil {
+					return trimmed, err
+				}
+				trimmed += n
+			}
+		}
+	}
+	if trimInfo.MaxDuration > 0 {
+		minId := minStreamID(cast.ToString(time.Now().Add(-trimInfo.MaxDuration).UnixMilli())+"-0", floor)
+		n, err := qr.client.XTrimMinIDApprox(ctx, stream, minId, trimInfo.Limit).Result()
+		if err != nil {
+			return trimmed, err
 		}
-		if trimInfo.MaxDuration > 0 {
-			minId := cast.ToString(time.Now().Add(-trimInfo.MaxDuration).UnixMilli())
-			qr.client.XTrimMinIDApprox(ctx, stream, minId, trimInfo.Limit)
+		trimmed += n
+	}
+	return trimmed, nil
+}
+
+// SafeTrimID returns the oldest entry ID of the stream that a group has not read or not acked yet,
+// trimming with MINID at it removes only entries all groups are done with.
+// A stream without groups returns "+", nothing is needed.
+func (qr *QueueRunner) SafeTrimID(ctx context.Context, stream string) (string, error) {
+	xInfoGroups, err := qr.client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		return "", err
+	}
+	floor := "+"
+	pipe := qr.client.Pipeline()
+	pendingCmds := make([]*redis.XPendingCmd, 0, len(xInfoGroups))
+	for _, xInfoGroup := range xInfoGroups {
+		floor = minStreamID(floor, nextStreamID(xInfoGroup.LastDeliveredID))
+		if xInfoGroup.Pending > 0 {
+			pendingCmds = append(pendingCmds, pipe.XPending(ctx, stream, xInfoGroup.Name))
+		}
+	}
+	if len(pendingCmds) == 0 {
+		return floor, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	for _, pendingCmd := range pendingCmds {
+		if pendingCmd.Val().Count > 0 {
+			floor = minStreamID(floor, pendingCmd.Val().Lower)
 		}
 	}
+	return floor, nil
 }
@@ -0,0 +1,106 @@
+// Copyright 2024 Moran. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package redisqueue
+
+import (
+	"context"
+	"fmt"
+)
+
+type Producer[T any] struct {
+	runner *QueueRunner
+	stream string
+	codec  Codec
+}
+
+func NewProducer[T any](runner *QueueRunner, stream string, codec Codec) *Producer[T] {
+	if runner == nil {
+		panic("nil runner")
+	}
+	if stream == "" {
+		panic("empty stream")
+	}
+	if codec == nil {
+		panic("nil codec")
+	}
+	return &Producer[T]{
+		runner: runner,
+		stream: stream,
+		codec:  codec,
+	}
+}
+
+func (p *Producer[T]) Send(ctx context.Context, v T) (string, error) {
+	return p.SendWithKey(ctx, "", v)
+}
+
+func (p *Producer[T]) SendWithKey(ctx context.Context, key string, v T) (string, error) {
+	data, err := p.codec.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	values := map[string]any{
+		valStr: data,
+		ctStr:  p.codec.ContentType(),
+	}
+	if key != "" {
+		values[keyStr] = key
+	}
+
+	return p.runner.xAdd(ctx, p.stream, values)
+}
+
+type TypedHandler[T any] func(ctx context.Context, delivery *Delivery, v T) error
+
+// Consumer decodes the payload into T before calling the handler.
+// Entries are decoded by the codec registered for their content type,
+// entries without one by the codec of the Consumer.
+// Entries that cannot be decoded are sent to the dead store without retrying.
+type Consumer[T any] struct {
+	info    *QueueInfo
+	codec   Codec
+	handler TypedHandler[T]
+}
+
+var _ IConsumer = (*Consumer[any])(nil)
+
+func NewConsumer[T any](info *QueueInfo, codec Codec, handler TypedHandler[T]) *Consumer[T] {
+	if codec == nil {
+		panic("nil codec")
+	}
+	if handler == nil {
+		panic("nil handler")
+	}
+	return &Consumer[T]{
+		info:    info,
+		codec:   codec,
+		handler: handler,
+	}
+}
+
+func (c *Consumer[T]) Info() *QueueInfo {
+	return c.info
+}
+
+func (c *Consumer[T]) Consume(ctx context.Context, delivery *Delivery) error {
+	v, err := c.decode(delivery)
+	if err != nil {
+		return Dead(err)
+	}
+	return c.handler(ctx, delivery, v)
+}
+
+func (c *Consumer[T]) decode(delivery *Delivery) (T, error) {
+	var v T
+	codec := c.codec
+	if contentType := delivery.ContentType(); contentType != "" && contentType != codec.ContentType() {
+		var ok bool
+		if codec, ok = lookupCodec(contentType); !ok {
+			return v, fmt.Errorf("%w: %s", ErrUnknownCodec, contentType)
+		}
+	}
+	err := codec.Unmarshal([]byte(delivery.Val()), &v)
+	return v, err
+}